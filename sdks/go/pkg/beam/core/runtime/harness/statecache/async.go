@@ -0,0 +1,195 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import "time"
+
+// InitAsync behaves like Init with a capacity of hard entries, additionally starting a
+// background goroutine that evicts entries once the cache holds more than soft of them.
+// Setting an input only evicts synchronously when the cache is at its hard capacity, so
+// that callers on latency sensitive paths rarely pay for eviction. The background evictor
+// respects token validity like any other eviction, so the cache may remain above soft
+// while its entries are in use. Returns an error if soft is not positive or exceeds hard.
+// Close must be called to stop the background goroutine.
+func (c *SideInputCache) InitAsync(soft, hard int, opts ...Option) error {
+	if soft <= 0 || soft > hard {
+		return newCacheError(ErrInvalidCapacity, "soft capacity must be a positive integer no greater than hard capacity %v, got %v", hard, soft)
+	}
+	if err := c.Init(hard, opts...); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.softCap = soft
+	c.evictReq = make(chan struct{}, 1)
+	c.stopEvictor = make(chan struct{})
+	c.evictorDone = make(chan struct{})
+	go c.runEvictor(c.evictReq, c.stopEvictor, c.evictorDone)
+	return nil
+}
+
+// Close stops the background evictor started by InitAsync, the janitor started by
+// WithJanitor, and the flusher started by WithMetricsFlush, and waits for them to exit. The
+// cache remains usable, evicting synchronously at its hard capacity and expiring entries
+// lazily. Calling Close more than once, or on a cache without background goroutines, is a
+// no-op.
+func (c *SideInputCache) Close() {
+	c.mu.Lock()
+	stop, done := c.stopEvictor, c.evictorDone
+	stopJanitor, janitorDone := c.stopJanitor, c.janitorDone
+	stopFlusher, flusherDone := c.stopFlusher, c.flusherDone
+	c.softCap = 0
+	c.stopEvictor = nil
+	c.stopJanitor = nil
+	c.stopFlusher = nil
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	if stopJanitor != nil {
+		close(stopJanitor)
+		<-janitorDone
+	}
+	if stopFlusher != nil {
+		close(stopFlusher)
+		<-flusherDone
+	}
+}
+
+// stopWorkers stops the background goroutines started by an earlier initialization without
+// waiting for them to exit, so that initializing the cache again does not leak them. It
+// should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) stopWorkers() {
+	for _, stop := range []*chan struct{}{&c.stopEvictor, &c.stopJanitor, &c.stopFlusher} {
+		if *stop != nil {
+			close(*stop)
+			*stop = nil
+		}
+	}
+	c.softCap = 0
+}
+
+// runEvictor drains the cache down to its soft capacity whenever requested, until stopped.
+func (c *SideInputCache) runEvictor(req, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-req:
+			c.lockForEviction()
+			if c.softCap > 0 {
+				c.evictUntil(func() bool { return len(c.cache) <= c.softCap })
+			}
+			c.unlock()
+		}
+	}
+}
+
+// signalEvictor requests a background eviction pass if the cache holds more entries than its
+// soft capacity. It never blocks, since a pending request already covers the new entries. It
+// should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) signalEvictor() {
+	if c.softCap <= 0 || len(c.cache) <= c.softCap {
+		return
+	}
+	select {
+	case c.evictReq <- struct{}{}:
+	default:
+	}
+}
+
+// startJanitor starts the janitor goroutine if WithJanitor set an interval and entries expire.
+// It should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) startJanitor() {
+	if c.janitorTick <= 0 || c.ttl <= 0 || c.stopJanitor != nil {
+		return
+	}
+	c.stopJanitor = make(chan struct{})
+	c.janitorDone = make(chan struct{})
+	go c.runJanitor(c.janitorTick, c.stopJanitor, c.janitorDone)
+}
+
+// runJanitor sweeps expired entries from the cache every interval, until stopped.
+func (c *SideInputCache) runJanitor(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	tick, stopTicker := c.newTicker(interval)
+	defer stopTicker()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+			c.sweepExpired()
+		}
+	}
+}
+
+// startFlusher starts the flusher goroutine if WithMetricsFlush set an interval and a
+// callback. It should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) startFlusher() {
+	if c.flushTick <= 0 || c.onFlush == nil || c.stopFlusher != nil {
+		return
+	}
+	c.stopFlusher = make(chan struct{})
+	c.flusherDone = make(chan struct{})
+	go c.runFlusher(c.flushTick, c.onFlush, c.stopFlusher, c.flusherDone)
+}
+
+// runFlusher passes a snapshot of the cache's Stats to f every interval, until stopped.
+func (c *SideInputCache) runFlusher(interval time.Duration, f func(Stats), stop, done chan struct{}) {
+	defer close(done)
+	tick, stopTicker := c.newTicker(interval)
+	defer stopTicker()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+			f(c.Stats())
+		}
+	}
+}
+
+// newTicker returns a channel delivering a tick every interval according to the cache's
+// clock, along with a function stopping it. The system clock's ticker is used unless the
+// clock set by WithClock provides tickers of its own.
+func (c *SideInputCache) newTicker(interval time.Duration) (<-chan time.Time, func()) {
+	if clk, ok := c.clock.(tickingClock); ok {
+		return clk.NewTicker(interval)
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// sweepExpired removes every expired entry that is neither in use nor pinned, as a query of
+// it would, returning the number removed.
+func (c *SideInputCache) sweepExpired() int {
+	c.mu.Lock()
+	defer c.unlock()
+	var n int
+	for key, entry := range c.cache {
+		if entry.stale || !c.isExpired(entry) || c.isValid(entry.tok) || c.pinned[key] {
+			continue
+		}
+		if c.removeStale(entry) {
+			c.metrics.Expirations++
+		}
+		n++
+	}
+	return n
+}
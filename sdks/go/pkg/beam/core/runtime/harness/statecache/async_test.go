@@ -0,0 +1,341 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInitAsync(t *testing.T) {
+	var s SideInputCache
+	err := s.InitAsync(1, 3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	defer s.Close()
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if len(s.Keys()) != 2 {
+		t.Fatalf("in use entries evicted, got %v", s.Keys())
+	}
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	// Exceeds the soft capacity, so the completed entries are evicted in the background.
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	deadline := time.Now().Add(10 * time.Second)
+	for len(s.Keys()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("background evictor did not drain to soft capacity, got %v", s.Keys())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := s.QueryCache("t3", "s3"); got == nil {
+		t.Errorf("in use entry evicted by background evictor")
+	}
+	if m := s.Metrics(); m.CapacityEvictions != 2 {
+		t.Errorf("number of evictions incorrect, expected 2, got %v", m.CapacityEvictions)
+	}
+}
+
+func TestInitAsync_Bad(t *testing.T) {
+	var s SideInputCache
+	if err := s.InitAsync(0, 2); err == nil {
+		t.Error("SideInputCache init succeeded with zero soft capacity but should have failed")
+	}
+	if err := s.InitAsync(3, 2); err == nil {
+		t.Error("SideInputCache init succeeded with soft capacity above hard capacity but should have failed")
+	}
+}
+
+func TestClose_StopsEvictor(t *testing.T) {
+	var s SideInputCache
+	err := s.InitAsync(1, 2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	done := s.evictorDone
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("background evictor still running after Close")
+	}
+	// Closing again, and using the cache afterwards, is safe.
+	s.Close()
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t1", "s2", makeTestReusableInput("t1", "s2", 20))
+	if got := s.QueryCache("t1", "s1"); got == nil {
+		t.Errorf("call to query cache missed after Close when should have hit")
+	}
+}
+
+func TestInitAsync_Twice(t *testing.T) {
+	var s SideInputCache
+	err := s.InitAsync(1, 2, WithTTL(time.Minute), WithJanitor(time.Minute))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	evictorDone, janitorDone := s.evictorDone, s.janitorDone
+	if err := s.InitAsync(1, 3); err != nil {
+		t.Fatalf("second cache init failed, got %v", err)
+	}
+	defer s.Close()
+	for name, done := range map[string]chan struct{}{"evictor": evictorDone, "janitor": janitorDone} {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v started by the first init still running after the second", name)
+		}
+	}
+
+	// The evictor started by the second init drains the cache.
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.CompleteBundle(tokOne, tokTwo)
+	s.SetValidTokens(makeRequest("t3", "s3", "tok3"))
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	deadline := time.Now().Add(10 * time.Second)
+	for len(s.Keys()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("background evictor did not drain to soft capacity, got %v", s.Keys())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSweepExpired(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(3, WithTTL(time.Minute), WithClock(clk))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	s.Pin("t3", "s3")
+	// Leave t2 in use.
+	s.CompleteBundle(tokOne, tokThree)
+	if n := s.sweepExpired(); n != 0 {
+		t.Errorf("sweep removed unexpired entries, got %v", n)
+	}
+
+	clk.advance(2 * time.Minute)
+	if n := s.sweepExpired(); n != 1 {
+		t.Errorf("number of swept entries incorrect, expected 1, got %v", n)
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; ok {
+		t.Errorf("expired entry not swept")
+	}
+	if len(s.cache) != 2 {
+		t.Errorf("in use or pinned entries swept, cache size %v", len(s.cache))
+	}
+	if s.metrics.Expirations != 1 {
+		t.Errorf("number of expirations incorrect, expected 1, got %v", s.metrics.Expirations)
+	}
+}
+
+func TestWithJanitor(t *testing.T) {
+	var s SideInputCache
+	clk := &lockedClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(1, WithTTL(time.Minute), WithClock(clk), WithJanitor(time.Millisecond))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	done := s.janitorDone
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.CompleteBundle(tok)
+	clk.advance(2 * time.Minute)
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("janitor did not sweep the expired entry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("janitor still running after Close")
+	}
+	// Closing again is safe.
+	s.Close()
+}
+
+func TestWithJanitor_NoTTL(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithJanitor(time.Millisecond))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if s.stopJanitor != nil {
+		t.Errorf("janitor started for a cache whose entries never expire")
+	}
+}
+
+func TestWithMetricsFlush(t *testing.T) {
+	var s SideInputCache
+	clk := &tickingFakeClock{lockedClock: lockedClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	flushed := make(chan Stats)
+	err := s.Init(2, WithClock(clk), WithMetricsFlush(time.Minute, func(st Stats) { flushed <- st }))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	done := s.flusherDone
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	clk.waitForTickers(t, 1)
+	go func() {
+		// Advancing by less than the interval does not flush.
+		clk.advance(30 * time.Second)
+		clk.advance(150 * time.Second)
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case st := <-flushed:
+			if st.Entries != 1 || st.Capacity != 2 {
+				t.Errorf("flushed stats incorrect, expected 1 of 2 entries, got %v of %v", st.Entries, st.Capacity)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("number of flushes incorrect, expected 3, got %v", i)
+		}
+	}
+
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flusher still running after Close")
+	}
+	// Ticks after Close are not delivered.
+	clk.advance(time.Hour)
+	select {
+	case <-flushed:
+		t.Error("stats flushed after Close")
+	default:
+	}
+}
+
+// tickingFakeClock is a lockedClock whose tickers tick as it is advanced.
+type tickingFakeClock struct {
+	lockedClock
+	tickers []*fakeTicker
+}
+
+type fakeTicker struct {
+	c       chan time.Time
+	d       time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (c *tickingFakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tk := &fakeTicker{c: make(chan time.Time), d: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, tk)
+	return tk.c, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		tk.stopped = true
+	}
+}
+
+// waitForTickers waits until n tickers have been created, so that advancing the clock ticks them.
+func (c *tickingFakeClock) waitForTickers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		c.mu.Lock()
+		created := len(c.tickers)
+		c.mu.Unlock()
+		if created >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("number of tickers incorrect, expected %v, got %v", n, created)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// advance moves the clock forward, delivering every tick that falls due to tickers that are
+// not stopped.
+func (c *tickingFakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	type tick struct {
+		tk *fakeTicker
+		at time.Time
+	}
+	var due []tick
+	for _, tk := range c.tickers {
+		for ; !tk.stopped && !tk.next.After(c.now); tk.next = tk.next.Add(tk.d) {
+			due = append(due, tick{tk, tk.next})
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		select {
+		case t.tk.c <- t.at:
+		case <-time.After(10 * time.Second):
+			// The ticker stopped while its tick was pending.
+		}
+	}
+}
+
+// lockedClock is a fakeClock safe to advance while the janitor reads it.
+type lockedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *lockedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *lockedClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,58 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDumpJSON(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCacheEmpty("t1", "s1")
+	s.CompleteBundle(tokTwo)
+
+	b, err := s.DumpJSON()
+	if err != nil {
+		t.Fatalf("DumpJSON failed, got %v", err)
+	}
+	var got cacheDump
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("failed to parse dump %s, got %v", b, err)
+	}
+	want := cacheDump{
+		Capacity:  3,
+		Occupancy: 2,
+		Metrics:   s.Metrics(),
+		Entries: []dumpEntry{
+			{TransformID: "t1", SideInputID: "s1", Token: []byte("tok1"), RefCount: 1, Empty: true},
+			{TransformID: "t2", SideInputID: "s2", Token: []byte("tok2"), RefCount: 0},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DumpJSON returned incorrect summary, expected %+v, got %+v", want, got)
+	}
+}
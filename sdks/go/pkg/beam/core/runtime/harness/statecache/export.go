@@ -0,0 +1,122 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+// MetricRegistry creates the metrics a SideInputCache pushes its counters to, so that the
+// cache can be integrated with any telemetry library through a small adapter.
+type MetricRegistry interface {
+	// Counter returns the counter with the given name.
+	Counter(name string) CounterHandle
+	// Gauge returns the gauge with the given name.
+	Gauge(name string) GaugeHandle
+}
+
+// CounterHandle is a monotonically increasing metric.
+type CounterHandle interface {
+	// Add increases the counter by delta, which is never negative.
+	Add(delta int64)
+}
+
+// GaugeHandle is a metric holding the latest value set.
+type GaugeHandle interface {
+	// Set records the current value.
+	Set(v int64)
+}
+
+// NoopRegistry is a MetricRegistry discarding every metric.
+type NoopRegistry struct{}
+
+// Counter returns a counter discarding every update.
+func (NoopRegistry) Counter(string) CounterHandle { return noopMetric{} }
+
+// Gauge returns a gauge discarding every update.
+func (NoopRegistry) Gauge(string) GaugeHandle { return noopMetric{} }
+
+type noopMetric struct{}
+
+func (noopMetric) Add(int64) {}
+func (noopMetric) Set(int64) {}
+
+// exporter pushes the metrics of a SideInputCache to the handles of a MetricRegistry.
+type exporter struct {
+	hits, misses, evictions CounterHandle
+	entries, bytes          GaugeHandle
+	last                    CacheMetrics // The metrics as of the last push
+}
+
+// exportedMetrics holds changes to the metrics awaiting a push.
+type exportedMetrics struct {
+	exp                     *exporter
+	hits, misses, evictions int64
+	entries, bytes          int64
+}
+
+// RegisterMetrics pushes the cache's metrics to counters and gauges created by reg: the
+// "hits", "misses", and "evictions" counters, the last counting every removal included in
+// TotalEvictions, and the "entries" and "bytes" gauges of the cache's occupancy. Updates are
+// pushed after the cache's lock is released by any call changing them, so the handles may
+// block briefly but must not use the cache; under concurrent use a gauge may briefly hold a
+// slightly older value. The first push includes the counts accumulated before registration.
+// Registering again replaces the previous registry.
+func (c *SideInputCache) RegisterMetrics(reg MetricRegistry) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.exporter = &exporter{
+		hits:      reg.Counter("hits"),
+		misses:    reg.Counter("misses"),
+		evictions: reg.Counter("evictions"),
+		entries:   reg.Gauge("entries"),
+		bytes:     reg.Gauge("bytes"),
+	}
+}
+
+// collectExport returns the changes to the exported metrics since the last push, and records
+// them as pushed. It should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) collectExport() exportedMetrics {
+	exp := c.exporter
+	if exp == nil {
+		return exportedMetrics{}
+	}
+	m := c.metrics
+	e := exportedMetrics{
+		exp:       exp,
+		hits:      m.Hits - exp.last.Hits,
+		misses:    m.Misses - exp.last.Misses,
+		evictions: m.totalEvictions() - exp.last.totalEvictions(),
+		entries:   int64(len(c.cache)),
+		bytes:     m.BytesInUse,
+	}
+	exp.last = m
+	return e
+}
+
+// push updates the registered handles with the collected changes.
+func (e exportedMetrics) push() {
+	if e.exp == nil {
+		return
+	}
+	if e.hits > 0 {
+		e.exp.hits.Add(e.hits)
+	}
+	if e.misses > 0 {
+		e.exp.misses.Add(e.misses)
+	}
+	if e.evictions > 0 {
+		e.exp.evictions.Add(e.evictions)
+	}
+	e.exp.entries.Set(e.entries)
+	e.exp.bytes.Set(e.bytes)
+}
@@ -0,0 +1,109 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"sync"
+	"testing"
+)
+
+// memRegistry is a MetricRegistry recording metrics in memory.
+type memRegistry struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+type memMetric struct {
+	reg  *memRegistry
+	name string
+}
+
+func (r *memRegistry) Counter(name string) CounterHandle { return memMetric{r, name} }
+func (r *memRegistry) Gauge(name string) GaugeHandle     { return memMetric{r, name} }
+
+func (r *memRegistry) get(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.values[name]
+}
+
+func (m memMetric) Add(delta int64) {
+	m.reg.mu.Lock()
+	defer m.reg.mu.Unlock()
+	if m.reg.values == nil {
+		m.reg.values = make(map[string]int64)
+	}
+	m.reg.values[m.name] += delta
+}
+
+func (m memMetric) Set(v int64) {
+	m.reg.mu.Lock()
+	defer m.reg.mu.Unlock()
+	if m.reg.values == nil {
+		m.reg.values = make(map[string]int64)
+	}
+	m.reg.values[m.name] = v
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(100, func(ReusableInput) int64 { return 10 })
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.QueryCache("t1", "s1")
+	reg := &memRegistry{}
+	s.RegisterMetrics(reg)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.QueryCache("t1", "s1")
+	s.Invalidate("t1", "s1")
+
+	want := map[string]int64{"hits": 2, "misses": 1, "evictions": 1, "entries": 0, "bytes": 0}
+	for name, v := range want {
+		if got := reg.get(name); got != v {
+			t.Errorf("metric %v incorrect, expected %v, got %v", name, v, got)
+		}
+	}
+
+	s.ResetMetrics()
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	want = map[string]int64{"hits": 3, "misses": 1, "evictions": 1, "entries": 1, "bytes": 10}
+	for name, v := range want {
+		if got := reg.get(name); got != v {
+			t.Errorf("metric %v after reset incorrect, expected %v, got %v", name, v, got)
+		}
+	}
+}
+
+func TestNoopRegistry(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.RegisterMetrics(NoopRegistry{})
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("call to query cache missed when should have hit")
+	}
+}
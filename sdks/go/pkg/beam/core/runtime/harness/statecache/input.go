@@ -0,0 +1,170 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import "github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+
+// valueInput is a ReusableInput holding a single value.
+type valueInput struct {
+	value interface{}
+}
+
+// NewValueInput returns a ReusableInput whose Value is always the given value, for
+// singleton side inputs already materialized in memory. Init and Reset do nothing.
+func NewValueInput(value interface{}) ReusableInput {
+	return &valueInput{value: value}
+}
+
+func (v *valueInput) Init() error {
+	return nil
+}
+
+func (v *valueInput) Value() interface{} {
+	return v.value
+}
+
+func (v *valueInput) Reset() error {
+	return nil
+}
+
+// BytesInput is a ReusableInput holding a side input as encoded bytes, which a cache
+// configured with WithValueCodec stores compressed.
+type BytesInput interface {
+	ReusableInput
+	// Bytes returns the encoded side input, which must not be modified.
+	Bytes() []byte
+}
+
+// Sizer is implemented by a ReusableInput able to estimate the memory it holds, which is
+// summed by SideInputCache.EstimatedBytes.
+type Sizer interface {
+	EstimatedBytes() int64
+}
+
+// bytesInput is a BytesInput whose bytes may have been compressed by a value codec.
+type bytesInput struct {
+	data       []byte
+	compressed bool // Whether data is compressed by the cache's value codec
+	rawLen     int  // Length of the bytes before compression
+}
+
+// NewBytesInput returns a BytesInput whose Value and Bytes are always the given bytes, for
+// side inputs kept in their encoded form and decoded by the caller. Init and Reset do
+// nothing. The bytes are not copied and must not be modified while in use.
+func NewBytesInput(b []byte) BytesInput {
+	return &bytesInput{data: b}
+}
+
+func (b *bytesInput) Init() error {
+	return nil
+}
+
+func (b *bytesInput) Value() interface{} {
+	return b.data
+}
+
+func (b *bytesInput) Reset() error {
+	return nil
+}
+
+func (b *bytesInput) Bytes() []byte {
+	return b.data
+}
+
+// EstimatedBytes returns the length of the bytes held, compressed if cached by a cache with a
+// value codec.
+func (b *bytesInput) EstimatedBytes() int64 {
+	return int64(len(b.data))
+}
+
+// compress returns the input to store in place of the given one, which is a compressed copy
+// if a value codec is configured and the input is a BytesInput. The input is stored as given
+// if it fails to compress. It should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) compress(input ReusableInput) ReusableInput {
+	b, ok := input.(BytesInput)
+	if !ok || c.encode == nil {
+		return input
+	}
+	if b, ok := b.(*bytesInput); ok && b.compressed {
+		return b
+	}
+	raw := b.Bytes()
+	data, err := c.encode(raw)
+	if err != nil {
+		return input
+	}
+	return &bytesInput{data: data, compressed: true, rawLen: len(raw)}
+}
+
+// read returns the input to hand to a query for the stored input, decompressing it if it was
+// compressed by the value codec and cloning it if copy on read is enabled. It should only be
+// called by a goroutine holding the write lock.
+func (c *SideInputCache) read(input ReusableInput) (ReusableInput, error) {
+	if b, ok := input.(*bytesInput); ok && b.compressed {
+		if c.decode == nil {
+			// Spilled by a cache with a value codec to a secondary shared with this one.
+			return nil, errors.New("no value codec to decompress input")
+		}
+		raw, err := c.decode(b.data)
+		if err != nil {
+			return nil, err
+		}
+		return NewBytesInput(raw), nil
+	}
+	if c.copyOnRead != nil {
+		return c.copyOnRead(input), nil
+	}
+	return input, nil
+}
+
+// sliceInput is a ReusableInput iterating over a slice of values.
+type sliceInput struct {
+	values []interface{}
+	next   int // Index of the value the iterator returns next.
+}
+
+// NewSliceInput returns a ReusableInput iterating over the given values, for iterable side
+// inputs already materialized in memory. Its Value is an iterator of type
+// func(*interface{}) bool, which sets its argument to the next value and returns true, or
+// returns false once every value has been returned. Init and Reset rewind the iterator to
+// the first value, so the values are offered again from the start on each use. The slice is
+// not copied and must not be modified while in use.
+func NewSliceInput(values []interface{}) ReusableInput {
+	return &sliceInput{values: values}
+}
+
+func (s *sliceInput) Init() error {
+	s.next = 0
+	return nil
+}
+
+func (s *sliceInput) Value() interface{} {
+	return s.iterate
+}
+
+func (s *sliceInput) Reset() error {
+	s.next = 0
+	return nil
+}
+
+func (s *sliceInput) iterate(v *interface{}) bool {
+	if s.next >= len(s.values) {
+		return false
+	}
+	*v = s.values[s.next]
+	s.next++
+	return true
+}
@@ -0,0 +1,182 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestNewValueInput(t *testing.T) {
+	in := NewValueInput(42)
+	for i := 0; i < 3; i++ {
+		if err := in.Init(); err != nil {
+			t.Fatalf("Init failed, got %v", err)
+		}
+		if got := in.Value(); got != 42 {
+			t.Errorf("Value in cycle %v incorrect, expected 42, got %v", i, got)
+		}
+		if err := in.Reset(); err != nil {
+			t.Fatalf("Reset failed, got %v", err)
+		}
+	}
+}
+
+// drain returns every value left in the iterator of a slice input.
+func drain(in ReusableInput) []interface{} {
+	iter := in.Value().(func(*interface{}) bool)
+	var got []interface{}
+	var v interface{}
+	for iter(&v) {
+		got = append(got, v)
+	}
+	return got
+}
+
+func TestNewSliceInput(t *testing.T) {
+	want := []interface{}{"a", "b", "c"}
+	in := NewSliceInput(want)
+	for i := 0; i < 3; i++ {
+		if err := in.Init(); err != nil {
+			t.Fatalf("Init failed, got %v", err)
+		}
+		if got := drain(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("values in cycle %v incorrect, expected %v, got %v", i, want, got)
+		}
+		if got := drain(in); got != nil {
+			t.Errorf("values after exhausting the iterator in cycle %v incorrect, expected none, got %v", i, got)
+		}
+		if err := in.Reset(); err != nil {
+			t.Fatalf("Reset failed, got %v", err)
+		}
+	}
+
+	// Reset rewinds a partially consumed iterator.
+	var v interface{}
+	in.Value().(func(*interface{}) bool)(&v)
+	in.Reset()
+	if got := drain(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("values after a partial read and Reset incorrect, expected %v, got %v", want, got)
+	}
+}
+
+func TestNewSliceInput_Empty(t *testing.T) {
+	in := NewSliceInput(nil)
+	in.Init()
+	if got := drain(in); got != nil {
+		t.Errorf("values of an empty slice input incorrect, expected none, got %v", got)
+	}
+}
+
+func gzipEncode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecode(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestWithValueCodec(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2, WithValueCodec(gzipEncode, gzipDecode))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	raw := bytes.Repeat([]byte("side input "), 1000)
+	tok := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tok, tokTwo)
+	s.SetCache("t1", "s1", NewBytesInput(raw))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+
+	stored := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}].input.(*bytesInput)
+	if !stored.compressed || len(stored.data) >= len(raw) {
+		t.Errorf("input not stored compressed, got %v bytes from %v", len(stored.data), len(raw))
+	}
+	for i := 0; i < 2; i++ {
+		in := s.QueryCache("t1", "s1")
+		if in == nil {
+			t.Fatalf("call to query cache missed when should have hit")
+		}
+		if got := in.(BytesInput).Bytes(); !bytes.Equal(got, raw) {
+			t.Errorf("decompressed input incorrect, got %v bytes", len(got))
+		}
+	}
+	if in, ok := s.QueryCache("t2", "s2").(*TestReusableInput); !ok || in.value != 20 {
+		t.Errorf("input not holding bytes altered by value codec, got %v", in)
+	}
+
+	m := s.Metrics()
+	if m.UncompressedBytes != int64(len(raw)) {
+		t.Errorf("number of uncompressed bytes incorrect, expected %v, got %v", len(raw), m.UncompressedBytes)
+	}
+	if m.CompressedBytes != int64(len(stored.data)) {
+		t.Errorf("number of compressed bytes incorrect, expected %v, got %v", len(stored.data), m.CompressedBytes)
+	}
+}
+
+func TestWithValueCodec_Failures(t *testing.T) {
+	errCodec := errors.New("codec failure")
+	var s SideInputCache
+	err := s.Init(2, WithValueCodec(
+		func(b []byte) ([]byte, error) {
+			if len(b) == 0 {
+				return nil, errCodec
+			}
+			return b, nil
+		},
+		func([]byte) ([]byte, error) { return nil, errCodec }))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tok, tokTwo)
+
+	// An input failing to compress is cached as is.
+	s.SetCache("t1", "s1", NewBytesInput(nil))
+	if in := s.QueryCache("t1", "s1"); in == nil || in.(BytesInput).Bytes() != nil {
+		t.Errorf("input failing to compress not cached as is, got %v", in)
+	}
+	// An input failing to decompress is removed.
+	s.SetCache("t2", "s2", NewBytesInput([]byte("data")))
+	in, status := s.QueryCacheWithStatus("t2", "s2")
+	if in != nil || status != MissEvicted {
+		t.Errorf("query of input failing to decompress incorrect, expected nil and %v, got %v and %v", MissEvicted, in, status)
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t2", SideInputID: "s2"}]; ok {
+		t.Errorf("input failing to decompress not removed")
+	}
+	if m := s.Metrics(); m.DecodeFailures != 1 || m.TotalEvictions != 1 {
+		t.Errorf("decode failures incorrect, expected 1 counted in total evictions, got %v and %v", m.DecodeFailures, m.TotalEvictions)
+	}
+}
@@ -0,0 +1,320 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Option configures optional behavior of a SideInputCache. Options are passed
+// to Init or InitWithByteLimit.
+type Option func(*SideInputCache)
+
+// WithTTL sets the maximum age of a cached input. Entries older than the TTL are
+// treated as a miss by QueryCache and lazily removed. A zero TTL, the default,
+// means entries never expire.
+func WithTTL(d time.Duration) Option {
+	return func(c *SideInputCache) {
+		c.ttl = d
+	}
+}
+
+// WithJanitor starts a background goroutine that removes expired entries every interval, so
+// that the memory of expired inputs which are never queried again is reclaimed. Entries in
+// use or pinned are left for later sweeps, and removals are counted by the Expirations
+// metric. Entries are only marked stale rather than removed if stale inputs are allowed with
+// WithAllowStale. It has no effect without WithTTL. Close must be called to stop the
+// janitor.
+func WithJanitor(interval time.Duration) Option {
+	return func(c *SideInputCache) {
+		c.janitorTick = interval
+	}
+}
+
+// WithMetricsFlush starts a background goroutine that passes a snapshot of the cache's Stats
+// to f every interval, for exporters that push metrics on a schedule rather than polling
+// Metrics. The callback is invoked on the goroutine without holding the cache's lock, so a
+// slow callback delays later flushes but not the cache. It has no effect unless interval is
+// positive and f is non-nil. Close must be called to stop the flusher.
+func WithMetricsFlush(interval time.Duration, f func(Stats)) Option {
+	return func(c *SideInputCache) {
+		c.flushTick = interval
+		c.onFlush = f
+	}
+}
+
+// WithMissBackoff enables the retry hint returned by QueryCacheWithRetryAfter. The hint
+// is initial after a first miss for a side input and doubles with each consecutive miss,
+// up to max. Backoff is disabled by default.
+func WithMissBackoff(initial, max time.Duration) Option {
+	return func(c *SideInputCache) {
+		c.backoff = initial
+		c.maxBackoff = max
+	}
+}
+
+// WithClock sets the clock used to age cached inputs and tokens, and to timestamp the
+// event log, in place of the system clock. If the clock also has a method
+//
+//	NewTicker(d time.Duration) (<-chan time.Time, func())
+//
+// returning the channel of a ticker along with a function stopping it, its tickers drive
+// the goroutines started by WithJanitor and WithMetricsFlush.
+func WithClock(clk clock) Option {
+	return func(c *SideInputCache) {
+		c.clock = clk
+	}
+}
+
+// WithEvictionOrder sets the built in eviction policy used to choose which entry is
+// evicted, in place of the default LRUOrder. It is overridden by the policy passed
+// to InitWithPolicy.
+func WithEvictionOrder(order EvictionStrategy) Option {
+	return func(c *SideInputCache) {
+		c.policy = order.newPolicy()
+	}
+}
+
+// WithRandSource sets the source of randomness of the RandomOrder and SampledLRU policies
+// chosen by WithEvictionOrder, in place of a source seeded with the current time, so that
+// tests and reproducible runs choose the same victims for the same sequence of operations.
+// The source is drawn from under a lock, so the option may be shared by the shards of a
+// ShardedSideInputCache, but the source must not be used elsewhere. Policies passed to
+// InitWithPolicy are unaffected.
+func WithRandSource(src rand.Source) Option {
+	locked := &lockedSource{src: src}
+	return func(c *SideInputCache) {
+		c.randSource = locked
+	}
+}
+
+// WithCopyOnRead sets a function used to clone a cached input before it is returned by a
+// query. By default every query returns the cached instance itself, so a bundle mutating
+// the input it was given corrupts it for every other bundle using the same side input.
+// The function is called while the cache's lock is held. Inputs shared between callers
+// coalesced by GetOrPopulate or QueryCacheContext while populating are not cloned.
+func WithCopyOnRead(f func(ReusableInput) ReusableInput) Option {
+	return func(c *SideInputCache) {
+		c.copyOnRead = f
+	}
+}
+
+// WithValueCodec sets functions compressing and decompressing the bytes of inputs created
+// by NewBytesInput, trading CPU for memory on large side inputs kept in their encoded
+// form. Inputs are compressed when cached and decompressed into a new BytesInput by each
+// query hitting them, so copy on read does not apply to them. An input failing to compress
+// is cached as is, while an input failing to decompress is removed and the query misses.
+// A sizer set by InitWithByteLimit is passed the compressed input, and the eviction
+// callback and secondary cache receive it too. Both functions are called while the cache's
+// lock is held, and must not modify the bytes they are passed.
+func WithValueCodec(encode, decode func([]byte) ([]byte, error)) Option {
+	return func(c *SideInputCache) {
+		c.encode = encode
+		c.decode = decode
+	}
+}
+
+// WithAllowStale keeps expired and invalidated inputs in the cache until they are
+// evicted, so that QueryCacheStale can return them for callers preferring slightly
+// old data over blocking on a refetch. Other queries still treat them as misses.
+func WithAllowStale() Option {
+	return func(c *SideInputCache) {
+		c.allowStale = true
+	}
+}
+
+// WithEvictionCallback sets a function invoked synchronously whenever an entry is
+// removed from the cache due to eviction, expiry, or Clear, or replaced by another
+// input for the same IDs, so that resources held by the input may be released. The
+// callback is invoked after the cache's lock is released and may use the cache, but
+// must not block indefinitely as it delays the return of the call that removed the
+// entry. Removing an empty entry recorded by SetCacheEmpty or a cached user state
+// read does not invoke the callback. Inputs implementing io.Closer are closed after
+// the callback returns.
+func WithEvictionCallback(f func(transformID, sideInputID string, in ReusableInput)) Option {
+	return func(c *SideInputCache) {
+		c.onEvict = f
+	}
+}
+
+// WithOverflowBuffer allows the cache to exceed its capacity by up to n entries when
+// every cached input is still in use, rather than dropping the new input. Entries
+// beyond capacity become ordinary eviction candidates once their tokens complete,
+// and are evicted as new inputs are cached. It has no effect on a cache bounded
+// by a byte limit.
+func WithOverflowBuffer(n int) Option {
+	return func(c *SideInputCache) {
+		c.overflow = n
+	}
+}
+
+// WithFreeNegativeEntries caches the empty entries recorded by SetCacheEmpty apart from the
+// capacity, bounded by their own capacity of n entries, so that a flood of side inputs known to
+// be empty never displaces cached inputs. Once n empty entries are cached, an empty entry that
+// is not in use, chosen by the eviction policy, is evicted to make room for another, and the
+// new entry is dropped if every empty entry is in use. It has no effect on a cache bounded by
+// a byte limit, where empty entries take no bytes, or for a non-positive n.
+func WithFreeNegativeEntries(n int) Option {
+	return func(c *SideInputCache) {
+		c.negCap = n
+	}
+}
+
+// WithEvictionBatch sets how many entries are evicted at once when an input needs room,
+// so that inserting many inputs amortizes the cost of finding eviction candidates over
+// fewer, larger evictions. More entries are evicted only if needed to fit the input, and
+// fewer if not enough are evictable; entries in use are never evicted. A batch of 1, the
+// default, evicts only what is needed.
+func WithEvictionBatch(n int) Option {
+	return func(c *SideInputCache) {
+		c.evictBatch = n
+	}
+}
+
+// WithEvictionVeto sets a function consulted for each entry that could be evicted, whose
+// eviction is vetoed if it returns true, for decisions based on runtime state beyond what Pin
+// expresses, such as not evicting while a checkpoint is in progress. An input that cannot be
+// cached since the only entries that could make room were vetoed is counted by the
+// VetoedEvictions metric rather than InUseEvictions. The function is called without holding
+// the cache's lock, once an operation needs to evict and before it evicts anything, so it may
+// use the cache; entries cached while it runs are not evicted by that operation. Caching an
+// input that fits calls it for no entry. Queries moving an input back from the secondary cache
+// do not consult the veto, so evict nothing to make room for it.
+func WithEvictionVeto(veto func(key CacheKey, in ReusableInput) bool) Option {
+	return func(c *SideInputCache) {
+		c.veto = veto
+	}
+}
+
+// WithStarvationAlert sets a function invoked once the cache fails to cache threshold
+// consecutive inputs because every cached input is still in use, which indicates
+// that the cache is too small for the bundles overlapping on the worker. The count
+// of consecutive failures restarts whenever an input is cached, so the function is
+// invoked once per streak. As with WithEvictionCallback, it is invoked after the
+// cache's lock is released.
+func WithStarvationAlert(threshold int, f func()) Option {
+	return func(c *SideInputCache) {
+		c.starveAt = threshold
+		c.onStarve = f
+	}
+}
+
+// WithUnderSizedCallback sets a function invoked with the ratio of in-use evictions among the
+// latest window attempts to cache an input once it reaches threshold, which indicates that the
+// cache is effectively useless for the workload as nearly every input is dropped. Attempts
+// count inputs cached and inputs dropped since every cached input is still in use, but not
+// inputs rejected for an invalid token, a nil input, or being oversized. The function is
+// invoked once the ratio reaches the threshold, and again only after it has dropped below.
+// As with WithEvictionCallback, it is invoked after the cache's lock is released. A
+// non-positive window disables the callback.
+func WithUnderSizedCallback(window int, threshold float64, f func(ratio float64)) Option {
+	return func(c *SideInputCache) {
+		if window <= 0 {
+			c.undersize, c.onUnder = nil, nil
+			return
+		}
+		c.undersize = &setWindow{inUse: make([]bool, window), threshold: threshold}
+		c.onUnder = f
+	}
+}
+
+// WithTracer sets a tracer starting a span for every call to GetOrPopulate, so that the
+// latency of populating side inputs can be correlated with pipeline stalls. Spans are tagged
+// with the namespace, if any, the transform ID, and the side input ID, along with an outcome
+// of "hit", "miss" if the call ran populate, or "coalesced" if it waited on another caller's
+// populate, and the error returned, if any. Without a tracer no spans are started.
+func WithTracer(t Tracer) Option {
+	return func(c *SideInputCache) {
+		c.tracer = t
+	}
+}
+
+// WithSecondary sets a secondary cache to which inputs evicted to make room for new ones
+// are spilled instead of being dropped. A query missing the cache checks the secondary
+// for an input spilled under the current token, and moves a found input back into the
+// cache. Spilled inputs are neither passed to the eviction callback nor closed. Put is
+// invoked after the cache's lock is released, while Get is invoked with it held, so
+// neither may use the cache.
+func WithSecondary(s SecondaryCache) Option {
+	return func(c *SideInputCache) {
+		c.secondary = s
+	}
+}
+
+// WithNamespace sets a namespace included in the key of every entry, such as a job ID, so
+// that pipelines sharing a worker, or a secondary cache, never see each other's entries for
+// the same transform and side input IDs. Queries and sets apply it transparently. The
+// default empty namespace leaves keys unchanged.
+func WithNamespace(namespace string) Option {
+	return func(c *SideInputCache) {
+		c.namespace = namespace
+	}
+}
+
+// WithMemoryPressureHook passes register a function that evicts the given fraction of the
+// evictable entries with EvictFraction, for a memory monitor to invoke under memory pressure,
+// for example after polling runtime.ReadMemStats. Register is called during initialization
+// while the cache's lock is held, so it must not invoke the function synchronously.
+func WithMemoryPressureHook(fraction float64, register func(onPressure func())) Option {
+	return func(c *SideInputCache) {
+		register(func() { c.EvictFraction(fraction) })
+	}
+}
+
+// WithTokenComparator sets a function reporting whether two cache tokens are equivalent, for
+// runners whose tokens may encode the same cached state with different bytes, such as tokens
+// carrying a version prefix. A token equivalent to one already valid, or to the token of a
+// cached input, is treated as that token. The default compares the bytes for equality. As a
+// custom comparator is called against every known token, it makes validating and completing
+// tokens take time linear in the number of valid tokens and cached inputs. The comparator must
+// be an equivalence relation and is called while the cache's lock is held.
+func WithTokenComparator(equal func(a, b []byte) bool) Option {
+	return func(c *SideInputCache) {
+		c.sameToken = equal
+	}
+}
+
+// WithStrictMode makes the cache panic on lifecycle misuse that it otherwise tolerates:
+// initializing it again rather than calling Reinit, even while it is empty, and completing
+// a bundle for a token with no active bundle, which is otherwise only counted by the
+// UnbalancedCompletions metric. Use SetStrictMode to also panic on caching or querying before
+// Init. It is meant to catch integration bugs in tests and development builds, and should not
+// be used in production.
+func WithStrictMode() Option {
+	return func(c *SideInputCache) {
+		c.strict = true
+	}
+}
+
+// WithMaxTokenRefcount limits the number of bundles that may use a cache token at once to n,
+// as a safety valve against runaway growth of a token's active bundles, which indicates a
+// runner bug or missed calls to CompleteBundle. Validating a token beyond the limit is
+// rejected, as reported by TrySetValidTokens. A non-positive n, the default, sets no limit.
+func WithMaxTokenRefcount(n int) Option {
+	return func(c *SideInputCache) {
+		c.maxRefs = n
+	}
+}
+
+// WithStuckTokenAge sets how long a token may remain valid before it is counted
+// by the StuckTokens metric, to detect bundles whose completion was never
+// reported. A zero age, the default, disables the metric.
+func WithStuckTokenAge(d time.Duration) Option {
+	return func(c *SideInputCache) {
+		c.stuckAge = d
+	}
+}
@@ -0,0 +1,333 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy chooses which entry a SideInputCache evicts when it is full.
+// A policy is only ever called by the cache while it holds its lock, so
+// implementations need not be safe for concurrent use.
+type EvictionPolicy interface {
+	// Touch records that the key was inserted into the cache or hit by a query.
+	Touch(key CacheKey)
+	// Remove forgets the key once it has left the cache.
+	Remove(key CacheKey)
+	// Victim returns the key the policy would evict next among those for which
+	// evictable returns true, or false if there is no such key.
+	Victim(evictable func(CacheKey) bool) (CacheKey, bool)
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	order *list.List // Front is the most recently used key.
+	elems map[CacheKey]*list.Element
+}
+
+// NewLRUPolicy returns an EvictionPolicy evicting the least recently used entry.
+// It is the default policy of a SideInputCache.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{order: list.New(), elems: make(map[CacheKey]*list.Element)}
+}
+
+func (p *lruPolicy) Touch(key CacheKey) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Remove(key CacheKey) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) Victim(evictable func(CacheKey) bool) (CacheKey, bool) {
+	for e := p.order.Back(); e != nil; e = e.Prev() {
+		if key := e.Value.(CacheKey); evictable(key) {
+			return key, true
+		}
+	}
+	return CacheKey{}, false
+}
+
+// insertionPolicy evicts the entry that was inserted first, ignoring hits.
+type insertionPolicy struct {
+	*lruPolicy
+}
+
+// NewInsertionPolicy returns an EvictionPolicy evicting the entry that was inserted
+// into the cache first, regardless of how often or recently it was hit.
+func NewInsertionPolicy() EvictionPolicy {
+	return insertionPolicy{&lruPolicy{order: list.New(), elems: make(map[CacheKey]*list.Element)}}
+}
+
+func (p insertionPolicy) Touch(key CacheKey) {
+	if _, ok := p.elems[key]; !ok {
+		p.elems[key] = p.order.PushFront(key)
+	}
+}
+
+// randomPolicy evicts a uniformly chosen entry.
+type randomPolicy struct {
+	rnd   *rand.Rand
+	keys  []CacheKey
+	index map[CacheKey]int // Maps keys to their position in keys.
+}
+
+// NewRandomPolicy returns an EvictionPolicy evicting an entry chosen uniformly at
+// random among those that may be evicted.
+func NewRandomPolicy() EvictionPolicy {
+	return &randomPolicy{rnd: rand.New(rand.NewSource(time.Now().UnixNano())), index: make(map[CacheKey]int)}
+}
+
+func (p *randomPolicy) Touch(key CacheKey) {
+	if _, ok := p.index[key]; !ok {
+		p.index[key] = len(p.keys)
+		p.keys = append(p.keys, key)
+	}
+}
+
+func (p *randomPolicy) Remove(key CacheKey) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy) Victim(evictable func(CacheKey) bool) (CacheKey, bool) {
+	var candidates []CacheKey
+	for _, key := range p.keys {
+		if evictable(key) {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return CacheKey{}, false
+	}
+	return candidates[p.rnd.Intn(len(candidates))], true
+}
+
+// randomized is implemented by the built in policies choosing victims at random, so that
+// WithRandSource can replace their time seeded source.
+type randomized interface {
+	setRand(rnd *rand.Rand)
+}
+
+func (p *randomPolicy) setRand(rnd *rand.Rand) {
+	p.rnd = rnd
+}
+
+// lockedSource is a rand.Source safe for concurrent use, so that a source set by
+// WithRandSource may be shared by the shards of a ShardedSideInputCache.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// seedPolicy makes a built in random policy chosen by WithEvictionOrder draw from the source
+// set by WithRandSource, if any. It should only be called by a goroutine holding the write
+// lock, once the options are applied.
+func (c *SideInputCache) seedPolicy() {
+	if p, ok := c.policy.(randomized); ok && c.randSource != nil {
+		p.setRand(rand.New(c.randSource))
+	}
+}
+
+// EvictionStrategy selects a built in eviction policy for WithEvictionOrder. It is
+// implemented by EvictionOrder and SampledLRU.
+type EvictionStrategy interface {
+	newPolicy() EvictionPolicy
+}
+
+// EvictionOrder selects one of the built in eviction policies.
+type EvictionOrder int
+
+const (
+	// LRUOrder evicts the least recently used entry, as NewLRUPolicy.
+	LRUOrder EvictionOrder = iota
+	// InsertionOrder evicts the first inserted entry, as NewInsertionPolicy.
+	InsertionOrder
+	// RandomOrder evicts a random entry, as NewRandomPolicy.
+	RandomOrder
+)
+
+func (o EvictionOrder) newPolicy() EvictionPolicy {
+	switch o {
+	case InsertionOrder:
+		return NewInsertionPolicy()
+	case RandomOrder:
+		return NewRandomPolicy()
+	default:
+		return NewLRUPolicy()
+	}
+}
+
+// lfuPolicy evicts the least frequently used entry.
+type lfuPolicy struct {
+	seq     uint64 // Incremented on every touch to break ties between equal counts.
+	entries map[CacheKey]*lfuEntry
+}
+
+type lfuEntry struct {
+	count uint64
+	last  uint64
+}
+
+// NewLFUPolicy returns an EvictionPolicy evicting the least frequently used entry,
+// counting the insertion and every hit of an entry since it was cached. Ties are
+// broken by evicting the least recently used of the tied entries.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{entries: make(map[CacheKey]*lfuEntry)}
+}
+
+func (p *lfuPolicy) Touch(key CacheKey) {
+	p.seq++
+	e, ok := p.entries[key]
+	if !ok {
+		e = &lfuEntry{}
+		p.entries[key] = e
+	}
+	e.count++
+	e.last = p.seq
+}
+
+func (p *lfuPolicy) Remove(key CacheKey) {
+	delete(p.entries, key)
+}
+
+func (p *lfuPolicy) Victim(evictable func(CacheKey) bool) (CacheKey, bool) {
+	var victim CacheKey
+	var best *lfuEntry
+	for key, e := range p.entries {
+		if !evictable(key) {
+			continue
+		}
+		if best == nil || e.count < best.count || (e.count == best.count && e.last < best.last) {
+			victim, best = key, e
+		}
+	}
+	return victim, best != nil
+}
+
+// SampledLRU selects a policy approximating LRU that evicts the least recently used of K
+// entries sampled at random, as NewSampledLRUPolicy(K). Choosing a victim takes O(K) time
+// rather than scanning past every entry in use, which matters for large caches whose least
+// recently used entries are mostly in use.
+type SampledLRU struct {
+	K int // Entries sampled per eviction, at least 1.
+}
+
+func (o SampledLRU) newPolicy() EvictionPolicy {
+	return NewSampledLRUPolicy(o.K)
+}
+
+// sampledPolicy evicts the least recently used of a random sample of entries.
+type sampledPolicy struct {
+	k     int
+	rnd   *rand.Rand
+	seq   uint64 // Incremented on every touch to order entries by recency.
+	keys  []CacheKey
+	elems map[CacheKey]*sampledEntry
+}
+
+type sampledEntry struct {
+	index int // Position of the key in keys.
+	last  uint64
+}
+
+// NewSampledLRUPolicy returns an EvictionPolicy evicting the least recently used of k entries
+// sampled at random among those cached, as Redis approximates LRU. Samples that may not be
+// evicted are discarded; if none of them may be, every entry is considered instead, so a victim
+// is always found when one exists. Values of k below 1 are treated as 1.
+func NewSampledLRUPolicy(k int) EvictionPolicy {
+	if k < 1 {
+		k = 1
+	}
+	return &sampledPolicy{k: k, rnd: rand.New(rand.NewSource(time.Now().UnixNano())), elems: make(map[CacheKey]*sampledEntry)}
+}
+
+func (p *sampledPolicy) setRand(rnd *rand.Rand) {
+	p.rnd = rnd
+}
+
+func (p *sampledPolicy) Touch(key CacheKey) {
+	p.seq++
+	e, ok := p.elems[key]
+	if !ok {
+		e = &sampledEntry{index: len(p.keys)}
+		p.elems[key] = e
+		p.keys = append(p.keys, key)
+	}
+	e.last = p.seq
+}
+
+func (p *sampledPolicy) Remove(key CacheKey) {
+	e, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[e.index] = p.keys[last]
+	p.elems[p.keys[e.index]].index = e.index
+	p.keys = p.keys[:last]
+	delete(p.elems, key)
+}
+
+func (p *sampledPolicy) Victim(evictable func(CacheKey) bool) (CacheKey, bool) {
+	var victim CacheKey
+	var best *sampledEntry
+	consider := func(key CacheKey) {
+		if e := p.elems[key]; (best == nil || e.last < best.last) && evictable(key) {
+			victim, best = key, e
+		}
+	}
+	if len(p.keys) > p.k {
+		for i := 0; i < p.k; i++ {
+			consider(p.keys[p.rnd.Intn(len(p.keys))])
+		}
+	}
+	if best == nil {
+		for _, key := range p.keys {
+			consider(key)
+		}
+	}
+	return victim, best != nil
+}
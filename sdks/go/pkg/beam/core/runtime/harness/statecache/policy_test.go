@@ -0,0 +1,273 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestEvictionPolicy_Victim(t *testing.T) {
+	a := CacheKey{TransformID: "t1", SideInputID: "s1"}
+	b := CacheKey{TransformID: "t2", SideInputID: "s2"}
+	c := CacheKey{TransformID: "t3", SideInputID: "s3"}
+	all := func(CacheKey) bool { return true }
+
+	tests := []struct {
+		name   string
+		policy EvictionPolicy
+		want   CacheKey
+	}{
+		// a is accessed in a burst, then b and c are touched once each after it.
+		{"LRU", NewLRUPolicy(), a},
+		{"LFU", NewLFUPolicy(), b},
+		{"Insertion", NewInsertionPolicy(), a},
+		{"SampledLRU", NewSampledLRUPolicy(5), a},
+	}
+	for _, test := range tests {
+		p := test.policy
+		p.Touch(a)
+		p.Touch(a)
+		p.Touch(a)
+		p.Touch(b)
+		p.Touch(c)
+		if got, ok := p.Victim(all); !ok || got != test.want {
+			t.Errorf("%v policy victim incorrect, expected %v, got %v", test.name, test.want, got)
+		}
+		// Keys that are not evictable are never chosen.
+		if got, ok := p.Victim(func(k CacheKey) bool { return k == c }); !ok || got != c {
+			t.Errorf("%v policy victim incorrect, expected %v, got %v", test.name, c, got)
+		}
+		p.Remove(c)
+		if got, ok := p.Victim(func(k CacheKey) bool { return k == c }); ok {
+			t.Errorf("%v policy returned removed key %v as victim", test.name, got)
+		}
+	}
+}
+
+func TestWithEvictionOrder(t *testing.T) {
+	tests := []struct {
+		order EvictionStrategy
+		want  string // The side input evicted after s1 and then s2 are cached and s1 is hit.
+	}{
+		{LRUOrder, "s2"},
+		{InsertionOrder, "s1"},
+		{SampledLRU{K: 5}, "s2"},
+	}
+	for _, test := range tests {
+		var s SideInputCache
+		err := s.Init(2, WithEvictionOrder(test.order))
+		if err != nil {
+			t.Fatalf("cache init failed, got %v", err)
+		}
+		tokOne := makeRequest("t1", "s1", "tok1")
+		tokTwo := makeRequest("t1", "s2", "tok2")
+		s.SetValidTokens(tokOne, tokTwo)
+		s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+		s.SetCache("t1", "s2", makeTestReusableInput("t1", "s2", 20))
+		s.QueryCache("t1", "s1")
+		s.CompleteBundle(tokOne, tokTwo)
+
+		s.SetValidTokens(makeRequest("t1", "s3", "tok3"))
+		s.SetCache("t1", "s3", makeTestReusableInput("t1", "s3", 30))
+		if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: test.want}]; ok {
+			t.Errorf("eviction order %v kept %v, expected it to be evicted", test.order, test.want)
+		}
+		if len(s.cache) != 2 {
+			t.Errorf("eviction order %v cache size incorrect, expected 2, got %v", test.order, len(s.cache))
+		}
+	}
+}
+
+func TestWithRandSource(t *testing.T) {
+	// victims returns the side inputs evicted while caching a sequence of inputs.
+	victims := func(order EvictionStrategy, seed int64) []string {
+		var evicted []string
+		var s SideInputCache
+		err := s.Init(4, WithEvictionOrder(order), WithRandSource(rand.NewSource(seed)),
+			WithEvictionCallback(func(_, sideInputID string, _ ReusableInput) {
+				evicted = append(evicted, sideInputID)
+			}))
+		if err != nil {
+			t.Fatalf("cache init failed, got %v", err)
+		}
+		for i := 0; i < 20; i++ {
+			side := fmt.Sprintf("s%d", i)
+			tok := makeRequest("t1", side, token(side))
+			s.SetValidTokens(tok)
+			s.SetCache("t1", side, makeTestReusableInput("t1", side, i))
+			s.CompleteBundle(tok)
+		}
+		return evicted
+	}
+
+	for _, order := range []EvictionStrategy{RandomOrder, SampledLRU{K: 2}} {
+		first, second := victims(order, 42), victims(order, 42)
+		if len(first) != 16 {
+			t.Fatalf("eviction order %v number of victims incorrect, expected 16, got %v", order, len(first))
+		}
+		if !reflect.DeepEqual(first, second) {
+			t.Errorf("eviction order %v victims differ for the same seed, got %v and %v", order, first, second)
+		}
+		if other := victims(order, 7); reflect.DeepEqual(first, other) {
+			t.Errorf("eviction order %v victims identical for different seeds, got %v", order, other)
+		}
+	}
+}
+
+func TestRandomPolicy_Victim(t *testing.T) {
+	a := CacheKey{TransformID: "t1", SideInputID: "s1"}
+	b := CacheKey{TransformID: "t2", SideInputID: "s2"}
+	p := NewRandomPolicy()
+	p.Touch(a)
+	p.Touch(b)
+	for i := 0; i < 10; i++ {
+		if got, ok := p.Victim(func(k CacheKey) bool { return k == b }); !ok || got != b {
+			t.Fatalf("random policy victim incorrect, expected %v, got %v", b, got)
+		}
+	}
+	p.Remove(b)
+	if got, ok := p.Victim(func(k CacheKey) bool { return k == b }); ok {
+		t.Errorf("random policy returned removed key %v as victim", got)
+	}
+	if got, ok := p.Victim(func(CacheKey) bool { return true }); !ok || got != a {
+		t.Errorf("random policy victim incorrect, expected %v, got %v", a, got)
+	}
+}
+
+func TestInitWithPolicy_LFU(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithPolicy(2, NewLFUPolicy())
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.QueryCache("t1", "s1")
+	// t2 is the most recently used, but the least frequently used.
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	if _, ok := s.cache[CacheKey{TransformID: "t2", SideInputID: "s2"}]; ok {
+		t.Errorf("least frequently used entry was not evicted")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("most frequently used entry was evicted")
+	}
+}
+
+func TestInitWithPolicy_Bad(t *testing.T) {
+	var s SideInputCache
+	if err := s.InitWithPolicy(1, nil); err == nil {
+		t.Error("SideInputCache init succeeded with nil policy but should have failed")
+	}
+}
+
+func TestSampledLRUPolicy_InUse(t *testing.T) {
+	const n = 1000
+	p := NewSampledLRUPolicy(3)
+	for i := 0; i < n; i++ {
+		p.Touch(CacheKey{TransformID: fmt.Sprintf("t%d", i)})
+	}
+	// Only one key in a hundred is evictable, so most samples are discarded.
+	evictable := func(k CacheKey) bool {
+		var i int
+		fmt.Sscanf(k.TransformID, "t%d", &i)
+		return i%100 == 0
+	}
+	for i := 0; i < n/100; i++ {
+		key, ok := p.Victim(evictable)
+		if !ok || !evictable(key) {
+			t.Fatalf("sampled LRU policy victim incorrect, expected an evictable key, got %v and %v", key, ok)
+		}
+		p.Remove(key)
+	}
+	if key, ok := p.Victim(evictable); ok {
+		t.Errorf("sampled LRU policy returned a victim with none evictable, got %v", key)
+	}
+}
+
+func TestSampledLRU_Cache(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(20, WithEvictionOrder(SampledLRU{K: 2}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	// Keep every even entry in use.
+	for i := 0; i < 40; i++ {
+		transID := fmt.Sprintf("t%d", i)
+		tok := makeRequest(transID, "s1", token(transID))
+		s.SetValidTokens(tok)
+		s.SetCache(transID, "s1", makeTestReusableInput(transID, "s1", i))
+		if i%2 == 1 {
+			s.CompleteBundle(tok)
+		}
+	}
+	for i := 0; i < 20; i += 2 {
+		if _, ok := s.cache[CacheKey{TransformID: fmt.Sprintf("t%d", i), SideInputID: "s1"}]; !ok {
+			t.Errorf("in use entry t%d was evicted", i)
+		}
+	}
+}
+
+// BenchmarkPolicy_Victim chooses victims from a large policy whose least recently
+// used half is in use, which the LRU policy must scan past on every call.
+func BenchmarkPolicy_Victim(b *testing.B) {
+	const n = 10000
+	keys := make([]CacheKey, n)
+	inUse := make(map[CacheKey]bool, n/2)
+	for i := range keys {
+		keys[i] = CacheKey{TransformID: fmt.Sprintf("t%d", i)}
+		if i < n/2 {
+			inUse[keys[i]] = true
+		}
+	}
+	evictable := func(k CacheKey) bool { return !inUse[k] }
+	for _, test := range []struct {
+		name   string
+		policy func() EvictionPolicy
+	}{
+		{"LRU", NewLRUPolicy},
+		{"SampledLRU", func() EvictionPolicy { return NewSampledLRUPolicy(5) }},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			p := test.policy()
+			for _, key := range keys {
+				p.Touch(key)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key, ok := p.Victim(evictable)
+				if !ok {
+					b.Fatalf("no victim found")
+				}
+				// Replace the victim to keep the policy's size constant.
+				p.Remove(key)
+				p.Touch(key)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+)
+
+// populateCall is an in-flight call to the populate function of GetOrPopulate,
+// shared by every caller waiting on the same key.
+type populateCall struct {
+	done  chan struct{} // Closed once input and err are set.
+	input ReusableInput
+	err   error
+}
+
+// GetOrPopulate returns the input cached for the transform ID and side input ID, calling
+// populate to produce it on a miss. Concurrent callers missing on the same side input are
+// coalesced, so that only one of them runs populate while the others wait for and share its
+// result. Populate is called without holding the cache's lock, so populates of different side
+// inputs run in parallel, and a key's in-flight call is forgotten once it returns. The
+// populated input is cached as with TrySetCache; if its token is not valid it is returned
+// without being cached. Errors from populate are returned to every waiting caller and nothing
+// is cached. A side input known to be empty via SetCacheEmpty is returned as a nil
+// ReusableInput without calling populate.
+func (c *SideInputCache) GetOrPopulate(transformID, sideInputID string, populate func() (ReusableInput, error)) (ReusableInput, error) {
+	key := c.sideInputKey(transformID, sideInputID)
+	c.mu.Lock()
+	span := c.startSpan(key)
+	if input, status := c.query(key); status == Hit || status == HitEmpty {
+		c.unlock()
+		endSpan(span, "hit", nil)
+		return input, nil
+	}
+	if call, ok := c.populating[key]; ok {
+		c.unlock()
+		<-call.done
+		endSpan(span, "coalesced", call.err)
+		return call.input, call.err
+	}
+	call := &populateCall{done: make(chan struct{})}
+	if c.populating == nil {
+		c.populating = make(map[CacheKey]*populateCall)
+	}
+	c.populating[key] = call
+	c.unlock()
+
+	// Reported to waiters only if populate panics.
+	call.err = errors.Errorf("populate of side input %v of transform %v panicked", sideInputID, transformID)
+	defer c.finishPopulate(key, call)
+	defer func() { endSpan(span, "miss", call.err) }()
+	call.input, call.err = populate()
+	return call.input, call.err
+}
+
+// finishPopulate caches the result of a successful populate call and releases
+// every caller waiting on it.
+func (c *SideInputCache) finishPopulate(key CacheKey, call *populateCall) {
+	c.withEvictionLock(func() {
+		delete(c.populating, key)
+		if call.err == nil {
+			c.trySet(key, call.input, 1, false)
+		}
+	})
+	close(call.done)
+}
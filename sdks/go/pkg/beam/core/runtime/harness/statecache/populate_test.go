@@ -0,0 +1,239 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+)
+
+func TestGetOrPopulate_Concurrent(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	populate := func() (ReusableInput, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return makeTestReusableInput("t1", "s1", 10), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]ReusableInput, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input, err := s.GetOrPopulate("t1", "s1", populate)
+			if err != nil {
+				t.Errorf("GetOrPopulate failed, got %v", err)
+			}
+			results[i] = input
+		}(i)
+	}
+	// Wait for the first caller to start populating before releasing it.
+	<-started
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("populate called %v times, expected 1", calls)
+	}
+	for i, input := range results {
+		if input == nil || input.Value().(int) != 10 {
+			t.Errorf("result %v incorrect, expected 10, got %v", i, input)
+		}
+	}
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("populated input was not cached")
+	}
+}
+
+func TestGetOrPopulate_DistinctKeys(t *testing.T) {
+	const n = 8
+	var s SideInputCache
+	err := s.Init(n)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tokens := makeBenchmarkTokens(n)
+	s.SetValidTokens(tokens...)
+
+	// Each populate waits for every other one to start, so they only all finish if
+	// populates of different keys run in parallel.
+	var started sync.WaitGroup
+	started.Add(n)
+	allStarted := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(allStarted)
+	}()
+	var wg sync.WaitGroup
+	for i, tok := range tokens {
+		side := tok.GetSideInput()
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(i, j int, transformID, sideInputID string) {
+				defer wg.Done()
+				_, err := s.GetOrPopulate(transformID, sideInputID, func() (ReusableInput, error) {
+					started.Done()
+					select {
+					case <-allStarted:
+					case <-time.After(10 * time.Second):
+						t.Errorf("populate of %v blocked by populates of other side inputs", transformID)
+					}
+					return makeTestReusableInput(transformID, sideInputID, i), nil
+				})
+				if err != nil {
+					t.Errorf("GetOrPopulate failed, got %v", err)
+				}
+			}(i, j, side.GetTransformId(), side.GetSideInputId())
+		}
+	}
+	wg.Wait()
+
+	if len(s.cache) != n {
+		t.Errorf("number of populated inputs cached incorrect, expected %v, got %v", n, len(s.cache))
+	}
+	if len(s.populating) != 0 {
+		t.Errorf("in-flight populates not cleaned up, got %v", len(s.populating))
+	}
+}
+
+func TestGetOrPopulate_Uncacheable(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	input, err := s.GetOrPopulate("t1", "s1", func() (ReusableInput, error) {
+		return makeTestReusableInput("t1", "s1", 10), nil
+	})
+	if err != nil || input == nil {
+		t.Errorf("GetOrPopulate incorrect, expected a populated input, got %v with error %v", input, err)
+	}
+	if len(s.cache) != 0 {
+		t.Errorf("input with invalid token was cached")
+	}
+}
+
+func TestGetOrPopulate_Error(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+
+	_, err = s.GetOrPopulate("t1", "s1", func() (ReusableInput, error) {
+		return nil, errors.New("populate failed")
+	})
+	if err == nil {
+		t.Errorf("GetOrPopulate succeeded but populate failed")
+	}
+	if len(s.cache) != 0 || len(s.populating) != 0 {
+		t.Errorf("failed populate left state behind, got %v entries and %v in-flight calls", len(s.cache), len(s.populating))
+	}
+}
+
+func TestQueryCacheContext_WaitsForPopulate(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go s.GetOrPopulate("t1", "s1", func() (ReusableInput, error) {
+		close(started)
+		<-release
+		return makeTestReusableInput("t1", "s1", 10), nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.QueryCacheContext(ctx, "t1", "s1"); err != context.Canceled {
+		t.Errorf("QueryCacheContext error incorrect, expected %v, got %v", context.Canceled, err)
+	}
+	// A lookup waiting for the populate returns once the context is done.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.QueryCacheContext(ctx, "t1", "s1"); err != context.DeadlineExceeded {
+		t.Errorf("QueryCacheContext error incorrect, expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	go close(release)
+	input, err := s.QueryCacheContext(context.Background(), "t1", "s1")
+	if err != nil || input == nil || input.Value().(int) != 10 {
+		t.Errorf("QueryCacheContext incorrect, expected the populated input, got %v with error %v", input, err)
+	}
+}
+
+// BenchmarkGetOrPopulate_DistinctKeys measures parallel populates of distinct side inputs,
+// compared with populates serialized by a single lock.
+func BenchmarkGetOrPopulate_DistinctKeys(b *testing.B) {
+	populate := func() (ReusableInput, error) {
+		time.Sleep(50 * time.Microsecond)
+		return makeTestReusableInput("t", "s", 1), nil
+	}
+	run := func(b *testing.B, populate func() (ReusableInput, error)) {
+		var s SideInputCache
+		if err := s.Init(1); err != nil {
+			b.Fatalf("cache init failed, got %v", err)
+		}
+		var next int64
+		b.SetParallelism(8)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				// Keys without a valid token always miss, so every call populates.
+				id := fmt.Sprintf("t%d", atomic.AddInt64(&next, 1))
+				if _, err := s.GetOrPopulate(id, "s", populate); err != nil {
+					b.Errorf("GetOrPopulate failed, got %v", err)
+				}
+			}
+		})
+	}
+
+	b.Run("perKey", func(b *testing.B) {
+		run(b, populate)
+	})
+	b.Run("global", func(b *testing.B) {
+		var mu sync.Mutex
+		run(b, func() (ReusableInput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return populate()
+		})
+	})
+}
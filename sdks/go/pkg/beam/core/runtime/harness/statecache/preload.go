@@ -0,0 +1,81 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+)
+
+// PreloadRequest identifies a side input to fetch and cache ahead of its use.
+type PreloadRequest struct {
+	TransformID string
+	SideInputID string
+}
+
+// Preload concurrently fetches the requested side inputs and places them into the
+// SideInputCache, so that fetch latency overlaps with other bundle setup. Only side
+// inputs whose tokens were marked valid via SetValidTokens, and that are not already
+// cached, are fetched. Fetched inputs are cached as with TrySetCache, respecting
+// capacity. A failed fetch does not abort the others; all fetch errors are combined
+// into the returned error. Requests not yet fetched when ctx is done are skipped and
+// reported with the context's error.
+func (c *SideInputCache) Preload(ctx context.Context, requests []PreloadRequest, fetch func(transformID, sideInputID string) (ReusableInput, error)) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+	for _, req := range requests {
+		if !c.needsPreload(req) {
+			continue
+		}
+		wg.Add(1)
+		go func(req PreloadRequest) {
+			defer wg.Done()
+			err := ctx.Err()
+			if err == nil {
+				var input ReusableInput
+				if input, err = fetch(req.TransformID, req.SideInputID); err == nil {
+					c.TrySetCache(req.TransformID, req.SideInputID, input)
+					return
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, errors.Wrapf(err, "failed to preload side input %v of transform %v", req.SideInputID, req.TransformID).Error())
+		}(req)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Errorf("failed to preload %d of %d side inputs:\n%v", len(errs), len(requests), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// needsPreload reports whether the request has a valid token and is not yet cached.
+func (c *SideInputCache) needsPreload(req PreloadRequest) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key := c.sideInputKey(req.TransformID, req.SideInputID)
+	tok, ok := c.makeAndValidateToken(key)
+	if !ok {
+		return false
+	}
+	entry, ok := c.cache[key]
+	return !ok || entry.tok != tok || entry.stale
+}
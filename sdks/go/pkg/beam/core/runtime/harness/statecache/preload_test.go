@@ -0,0 +1,89 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+)
+
+func TestPreload(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+
+	var mu sync.Mutex
+	fetched := make(map[string]bool)
+	fetch := func(transformID, sideInputID string) (ReusableInput, error) {
+		mu.Lock()
+		fetched[transformID+sideInputID] = true
+		mu.Unlock()
+		if transformID == "t2" {
+			return nil, errors.New("fetch failed")
+		}
+		return makeTestReusableInput(transformID, sideInputID, 10), nil
+	}
+	err = s.Preload(context.Background(), []PreloadRequest{
+		{"t1", "s1"},
+		{"t2", "s2"},
+		// Already cached, so not fetched.
+		{"t3", "s3"},
+		// Not valid, so not fetched.
+		{"t4", "s4"},
+	}, fetch)
+	if err == nil {
+		t.Errorf("Preload succeeded but fetch of t2 should have failed")
+	}
+	if !fetched["t1s1"] || !fetched["t2s2"] || fetched["t3s3"] || fetched["t4s4"] {
+		t.Errorf("fetched side inputs incorrect, expected t1s1 and t2s2, got %v", fetched)
+	}
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("preloaded side input was not cached")
+	}
+	if output := s.QueryCache("t2", "s2"); output != nil {
+		t.Errorf("failed side input was cached, got %v", output)
+	}
+}
+
+func TestPreload_Cancelled(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.Preload(ctx, []PreloadRequest{{TransformID: "t1", SideInputID: "s1"}}, func(transformID, sideInputID string) (ReusableInput, error) {
+		t.Errorf("fetch called after context was cancelled")
+		return nil, nil
+	})
+	if err == nil {
+		t.Errorf("Preload succeeded with a cancelled context but should have failed")
+	}
+}
@@ -0,0 +1,71 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+// SecondaryCache is a slower tier, such as an on-disk store, holding side inputs
+// evicted from a SideInputCache to make room for new ones. The SideInputCache
+// tracks the token each spilled input was cached under, so a secondary cache need
+// not handle tokens or invalidation; it may also drop inputs at any time.
+type SecondaryCache interface {
+	// Get returns the input last put for the key, or false if it is not held.
+	Get(key CacheKey) (ReusableInput, bool)
+	// Put stores the input for the key, replacing any input already held.
+	Put(key CacheKey, input ReusableInput)
+}
+
+// evictForRoom evicts the entry to make room for new inputs, spilling it to the secondary
+// cache rather than dropping it if one is configured. Empty, stale, and user state entries
+// are never spilled. The key is recorded for SetCacheEx while it collects evictions. It should
+// only be called by a goroutine holding the write lock.
+func (c *SideInputCache) evictForRoom(entry *cacheEntry) {
+	if c.displaced != nil {
+		*c.displaced = append(*c.displaced, entry.key)
+	}
+	if c.secondary == nil || entry.empty || entry.stale || entry.key.UserStateID != "" {
+		c.evict(entry)
+		return
+	}
+	c.removeEntry(entry)
+	c.metrics.LifetimeSamples++
+	c.metrics.TotalLifetime += c.now().Sub(entry.inserted)
+	c.logEvent("spill", entry.key, entry.tok)
+	c.spilled[entry.key] = &cacheEntry{key: entry.key, tok: entry.tok, weight: entry.weight, inserted: entry.inserted}
+	c.spills = append(c.spills, entry)
+}
+
+// promote returns the input spilled to the secondary cache for the key under the given token,
+// moving it back into the cache if there is room. It should only be called by a goroutine
+// holding the write lock.
+func (c *SideInputCache) promote(key CacheKey, tok token) (ReusableInput, bool) {
+	spilled, ok := c.spilled[key]
+	if !ok || spilled.tok != tok {
+		return nil, false
+	}
+	if c.isExpired(spilled) {
+		delete(c.spilled, key)
+		return nil, false
+	}
+	input, ok := c.secondary.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if c.trySet(key, input, spilled.weight, false) {
+		c.cache[key].inserted = spilled.inserted
+		delete(c.spilled, key)
+	}
+	c.metrics.SecondaryHits++
+	return input, true
+}
@@ -0,0 +1,107 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"sync"
+	"testing"
+)
+
+// fakeSecondary is an in-memory SecondaryCache.
+type fakeSecondary struct {
+	mu     sync.Mutex
+	inputs map[CacheKey]ReusableInput
+}
+
+func (f *fakeSecondary) Get(key CacheKey) (ReusableInput, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	input, ok := f.inputs[key]
+	return input, ok
+}
+
+func (f *fakeSecondary) Put(key CacheKey, input ReusableInput) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.inputs == nil {
+		f.inputs = make(map[CacheKey]ReusableInput)
+	}
+	f.inputs[key] = input
+}
+
+func TestSecondaryCache(t *testing.T) {
+	var s SideInputCache
+	secondary := &fakeSecondary{}
+	var evicted int
+	err := s.Init(1, WithSecondary(secondary), WithEvictionCallback(func(string, string, ReusableInput) { evicted++ }))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	inOne := makeTestReusableInput("t1", "s1", 10)
+	inTwo := makeTestReusableInput("t2", "s2", 20)
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", inOne)
+	s.CompleteBundle(tokOne)
+	s.SetValidTokens(tokTwo)
+	s.SetCache("t2", "s2", inTwo)
+	if _, ok := secondary.Get(CacheKey{TransformID: "t1", SideInputID: "s1"}); !ok {
+		t.Fatalf("evicted input not spilled to the secondary cache")
+	}
+	if evicted != 0 {
+		t.Errorf("eviction callback invoked for a spilled input %v times", evicted)
+	}
+	s.CompleteBundle(tokTwo)
+
+	// A query under the same token promotes the spilled input, spilling the other.
+	s.SetValidTokens(tokOne)
+	if output := s.QueryCache("t1", "s1"); output != inOne {
+		t.Errorf("QueryCache incorrect, expected spilled input %v, got %v", inOne, output)
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("spilled input not promoted back into the cache")
+	}
+	if _, ok := secondary.Get(CacheKey{TransformID: "t2", SideInputID: "s2"}); !ok {
+		t.Errorf("input evicted by promotion not spilled to the secondary cache")
+	}
+	if s.metrics.SecondaryHits != 1 {
+		t.Errorf("number of secondary hits incorrect, expected 1, got %v", s.metrics.SecondaryHits)
+	}
+	if s.metrics.Hits != 1 {
+		t.Errorf("number of hits incorrect, expected 1, got %v", s.metrics.Hits)
+	}
+	s.CompleteBundle(tokOne)
+
+	// A spilled input is not returned under a new token.
+	s.SetValidTokens(makeRequest("t2", "s2", "tok3"))
+	if output := s.QueryCache("t2", "s2"); output != nil {
+		t.Errorf("QueryCache returned an input spilled under an old token, got %v", output)
+	}
+
+	// Nor once invalidated.
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 30))
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; ok {
+		t.Fatalf("input not evicted to make room")
+	}
+	s.SetValidTokens(tokOne)
+	s.Invalidate("t1", "s1")
+	s.SetValidTokens(tokOne)
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("QueryCache returned an invalidated spilled input, got %v", output)
+	}
+}
@@ -0,0 +1,194 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	fnpb "github.com/apache/beam/sdks/v2/go/pkg/beam/model/fnexecution_v1"
+)
+
+// ShardedSideInputCache spreads cached side inputs across several independent
+// SideInputCaches, each with its own lock, to reduce lock contention on workers
+// running many bundles concurrently. Each key is owned by a single shard, chosen
+// by hashing the key, and the capacity is divided evenly across the shards.
+//
+// Eviction and token validity operate per shard, so a shard may have to drop a
+// new input while another shard still has evictable entries. The cache as a
+// whole therefore evicts slightly less optimally than a single SideInputCache
+// of the same total capacity.
+type ShardedSideInputCache struct {
+	shards          []SideInputCache
+	completeBundles int64 // Counted here, since a bundle may not involve every shard.
+}
+
+// InitSharded initializes the cache with the given total capacity divided across
+// the given number of shards, applying the options to every shard. Returns an
+// error if either is non-positive, or if there are more shards than entries.
+//
+// Options starting goroutines, such as WithJanitor, start them in every shard, and
+// Close must be called to stop them. In particular, the callback set by
+// WithMetricsFlush is called once per shard with the Stats of that shard alone.
+func (c *ShardedSideInputCache) InitSharded(cap, shards int, opts ...Option) error {
+	if shards <= 0 || shards > cap {
+		return newCacheError(ErrInvalidCapacity, "shard count must be a positive integer no greater than capacity %v, got %v", cap, shards)
+	}
+	c.shards = make([]SideInputCache, shards)
+	for i := range c.shards {
+		// Hand out the remainder one entry at a time to the first shards.
+		size := cap / shards
+		if i < cap%shards {
+			size++
+		}
+		if err := c.shards[i].Init(size, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the goroutines started by the options of every shard, as
+// SideInputCache.Close does, and waits for them to exit.
+func (c *ShardedSideInputCache) Close() {
+	for i := range c.shards {
+		c.shards[i].Close()
+	}
+}
+
+// shard returns the shard owning the key.
+func (c *ShardedSideInputCache) shard(key CacheKey) *SideInputCache {
+	h := fnv.New32a()
+	h.Write([]byte(key.TransformID))
+	h.Write([]byte{0})
+	h.Write([]byte(key.SideInputID))
+	h.Write([]byte{0})
+	h.Write([]byte(key.UserStateID))
+	return &c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+// route groups the tokens by the shards they apply to. Side input tokens apply to
+// the shard owning their key, while user state tokens apply to every shard.
+func (c *ShardedSideInputCache) route(cacheTokens []fnpb.ProcessBundleRequest_CacheToken) map[*SideInputCache][]fnpb.ProcessBundleRequest_CacheToken {
+	routed := make(map[*SideInputCache][]fnpb.ProcessBundleRequest_CacheToken)
+	for _, tok := range cacheTokens {
+		if s := tok.GetSideInput(); s != nil {
+			shard := c.shard(CacheKey{TransformID: s.GetTransformId(), SideInputID: s.GetSideInputId()})
+			routed[shard] = append(routed[shard], tok)
+		} else if tok.GetUserState() != nil {
+			for i := range c.shards {
+				routed[&c.shards[i]] = append(routed[&c.shards[i]], tok)
+			}
+		}
+	}
+	return routed
+}
+
+// SetValidTokens behaves like SideInputCache.SetValidTokens, validating each token
+// in the shards it applies to. Returns the number of tokens applied summed over the
+// shards, in which a user state token counts once for every shard.
+func (c *ShardedSideInputCache) SetValidTokens(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) int {
+	var applied int
+	for shard, toks := range c.route(cacheTokens) {
+		applied += shard.SetValidTokens(toks...)
+	}
+	return applied
+}
+
+// CompleteBundle behaves like SideInputCache.CompleteBundle, completing each token
+// in the shards it applies to.
+func (c *ShardedSideInputCache) CompleteBundle(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) {
+	for shard, toks := range c.route(cacheTokens) {
+		shard.CompleteBundle(toks...)
+	}
+	atomic.AddInt64(&c.completeBundles, 1)
+}
+
+// QueryCache behaves like SideInputCache.QueryCache.
+func (c *ShardedSideInputCache) QueryCache(transformID, sideInputID string) ReusableInput {
+	return c.shard(CacheKey{TransformID: transformID, SideInputID: sideInputID}).QueryCache(transformID, sideInputID)
+}
+
+// SetCache behaves like SideInputCache.SetCache, where the cache is full if the
+// shard owning the side input is.
+func (c *ShardedSideInputCache) SetCache(transformID, sideInputID string, input ReusableInput) {
+	c.shard(CacheKey{TransformID: transformID, SideInputID: sideInputID}).SetCache(transformID, sideInputID, input)
+}
+
+// TrySetCache behaves like SideInputCache.TrySetCache, where the cache is full if
+// the shard owning the side input is.
+func (c *ShardedSideInputCache) TrySetCache(transformID, sideInputID string, input ReusableInput) bool {
+	return c.shard(CacheKey{TransformID: transformID, SideInputID: sideInputID}).TrySetCache(transformID, sideInputID, input)
+}
+
+// QueryMultimapCache behaves like SideInputCache.QueryMultimapCache. Every lookup key of a
+// side input is owned by the shard owning the side input, where its token is valid.
+func (c *ShardedSideInputCache) QueryMultimapCache(transformID, sideInputID, lookupKey string) ReusableInput {
+	return c.shard(CacheKey{TransformID: transformID, SideInputID: sideInputID}).QueryMultimapCache(transformID, sideInputID, lookupKey)
+}
+
+// SetMultimapCache behaves like SideInputCache.SetMultimapCache, where the cache is full
+// if the shard owning the side input is.
+func (c *ShardedSideInputCache) SetMultimapCache(transformID, sideInputID, lookupKey string, input ReusableInput) {
+	c.shard(CacheKey{TransformID: transformID, SideInputID: sideInputID}).SetMultimapCache(transformID, sideInputID, lookupKey, input)
+}
+
+// Metrics returns the metrics of the shards summed together. Peaks and stuck tokens
+// are summed per shard, so they overstate the whole cache if the shards peaked at
+// different times or share tokens.
+func (c *ShardedSideInputCache) Metrics() CacheMetrics {
+	var m CacheMetrics
+	for i := range c.shards {
+		m.add(c.shards[i].Metrics())
+	}
+	m.CompleteBundles = atomic.LoadInt64(&c.completeBundles)
+	return m
+}
+
+// add sums the other metrics into m.
+func (m *CacheMetrics) add(o CacheMetrics) {
+	m.Hits += o.Hits
+	m.Misses += o.Misses
+	m.CapacityEvictions += o.CapacityEvictions
+	m.InUseEvictions += o.InUseEvictions
+	m.BytesInUse += o.BytesInUse
+	m.CompleteBundles += o.CompleteBundles
+	m.Expirations += o.Expirations
+	m.Flushes += o.Flushes
+	m.QuotaEvictions += o.QuotaEvictions
+	m.ManualInvalidations += o.ManualInvalidations
+	m.PressureEvictions += o.PressureEvictions
+	m.SecondaryHits += o.SecondaryHits
+	m.CapacityShortfall += o.CapacityShortfall
+	m.InitFailures += o.InitFailures
+	m.SupersededEvictions += o.SupersededEvictions
+	m.DecodeFailures += o.DecodeFailures
+	m.UncompressedBytes += o.UncompressedBytes
+	m.CompressedBytes += o.CompressedBytes
+	m.NilRejections += o.NilRejections
+	m.DroppedEvents += o.DroppedEvents
+	m.VetoedEvictions += o.VetoedEvictions
+	m.StuckTokens += o.StuckTokens
+	m.OversizedRejections += o.OversizedRejections
+	m.PeakEntries += o.PeakEntries
+	m.PeakBytes += o.PeakBytes
+	m.UnbalancedCompletions += o.UnbalancedCompletions
+	m.ConsecutiveInUseEvictions += o.ConsecutiveInUseEvictions
+	m.LifetimeSamples += o.LifetimeSamples
+	m.TotalLifetime += o.TotalLifetime
+	m.TotalEvictions += o.TotalEvictions
+	m.PinnedEntries += o.PinnedEntries
+}
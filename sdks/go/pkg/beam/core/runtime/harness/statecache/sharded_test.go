@@ -0,0 +1,158 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInitSharded(t *testing.T) {
+	var s ShardedSideInputCache
+	err := s.InitSharded(10, 3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	total := 0
+	for i := range s.shards {
+		total += s.shards[i].capacity
+	}
+	if total != 10 {
+		t.Errorf("total shard capacity incorrect, expected 10, got %v", total)
+	}
+
+	var bad ShardedSideInputCache
+	if err := bad.InitSharded(2, 3); err == nil {
+		t.Error("sharded cache init succeeded with more shards than entries but should have failed")
+	}
+}
+
+func TestShardedSideInputCache(t *testing.T) {
+	var s ShardedSideInputCache
+	err := s.InitSharded(100, 4)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokens := makeBenchmarkTokens(20)
+	if n := s.SetValidTokens(tokens...); n != len(tokens) {
+		t.Errorf("number of tokens applied incorrect, expected %v, got %v", len(tokens), n)
+	}
+	if n := s.SetValidTokens(makeUserStateRequest("tok1")); n != 4 {
+		t.Errorf("number of user state tokens applied incorrect, expected 4, got %v", n)
+	}
+	for _, tok := range tokens {
+		side := tok.GetSideInput()
+		s.SetCache(side.GetTransformId(), side.GetSideInputId(), makeTestReusableInput(side.GetTransformId(), side.GetSideInputId(), 1))
+	}
+	for _, tok := range tokens {
+		side := tok.GetSideInput()
+		if got := s.QueryCache(side.GetTransformId(), side.GetSideInputId()); got == nil {
+			t.Errorf("call to query cache missed for %v when should have hit", side)
+		}
+	}
+	s.CompleteBundle(tokens...)
+	if got := s.QueryCache("t000", "s000"); got != nil {
+		t.Errorf("call to query cache hit after CompleteBundle when should have missed, got %v", got)
+	}
+
+	m := s.Metrics()
+	if m.Hits != 20 {
+		t.Errorf("number of hits incorrect, expected 20, got %v", m.Hits)
+	}
+	if m.CompleteBundles != 1 {
+		t.Errorf("number of completed bundles incorrect, expected 1, got %v", m.CompleteBundles)
+	}
+	used := 0
+	for i := range s.shards {
+		if len(s.shards[i].cache) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("side inputs not spread across shards, got %v shards used", used)
+	}
+}
+
+// BenchmarkShardedQueryCache compares a single SideInputCache with a sharded one under
+// parallel queries and sets.
+func BenchmarkShardedQueryCache(b *testing.B) {
+	const n = 256
+	tokens := makeBenchmarkTokens(n)
+	keys := make([]CacheKey, n)
+	for i, tok := range tokens {
+		side := tok.GetSideInput()
+		keys[i] = CacheKey{TransformID: side.GetTransformId(), SideInputID: side.GetSideInputId()}
+	}
+	input := makeTestReusableInput("t", "s", 1)
+	run := func(b *testing.B, query func(string, string) ReusableInput, set func(string, string, ReusableInput)) {
+		for _, key := range keys {
+			set(key.TransformID, key.SideInputID, input)
+		}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				key := keys[i%n]
+				if i%20 == 0 {
+					set(key.TransformID, key.SideInputID, input)
+				} else {
+					query(key.TransformID, key.SideInputID)
+				}
+			}
+		})
+	}
+
+	b.Run("single", func(b *testing.B) {
+		var s SideInputCache
+		if err := s.Init(n); err != nil {
+			b.Fatalf("cache init failed, got %v", err)
+		}
+		s.SetValidTokens(tokens...)
+		run(b, s.QueryCache, s.SetCache)
+	})
+	b.Run("sharded", func(b *testing.B) {
+		var s ShardedSideInputCache
+		if err := s.InitSharded(n, 16); err != nil {
+			b.Fatalf("cache init failed, got %v", err)
+		}
+		s.SetValidTokens(tokens...)
+		run(b, s.QueryCache, s.SetCache)
+	})
+}
+
+func TestShardedClose(t *testing.T) {
+	var s ShardedSideInputCache
+	err := s.InitSharded(4, 2, WithTTL(time.Minute), WithJanitor(time.Millisecond), WithMetricsFlush(time.Millisecond, func(Stats) {}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	var done []chan struct{}
+	for i := range s.shards {
+		if s.shards[i].janitorDone == nil || s.shards[i].flusherDone == nil {
+			t.Fatalf("shard %v did not start its janitor and flusher", i)
+		}
+		done = append(done, s.shards[i].janitorDone, s.shards[i].flusherDone)
+	}
+	s.Close()
+	for _, d := range done {
+		select {
+		case <-d:
+		case <-time.After(10 * time.Second):
+			t.Fatal("shard goroutine still running after Close")
+		}
+	}
+	// Closing again is safe.
+	s.Close()
+}
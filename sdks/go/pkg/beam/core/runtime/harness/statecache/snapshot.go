@@ -0,0 +1,116 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+)
+
+// snapshotVersion is the version of the serialized format written by Snapshot.
+// It must be incremented whenever the format changes, and Restore must keep
+// accepting every earlier version.
+//
+// Version 1 identified side inputs by the concatenation of their transform ID
+// and side input ID. Version 2 stores the IDs separately. Version 3 adds the
+// user state token. Version 4 allows active bundle counts above 127.
+const snapshotVersion = 4
+
+// snapshot is the serialized form of the token state of a SideInputCache.
+// Tokens are stored as bytes since they are opaque and need not be valid UTF-8.
+type snapshot struct {
+	Version     int
+	ValidTokens []snapshotToken
+	IDsToTokens []snapshotID
+	StateToken  []byte `json:",omitempty"` // Only set from version 3.
+}
+
+type snapshotToken struct {
+	Token []byte
+	Count int
+}
+
+type snapshotID struct {
+	ID          string `json:",omitempty"` // Only set by version 1.
+	TransformID string
+	SideInputID string
+	Token       []byte
+}
+
+// Snapshot serializes the valid tokens and the mapping of IDs to tokens of the
+// SideInputCache so that they can be persisted and later passed to Restore. The
+// cached inputs themselves are not serializable and are not included.
+func (c *SideInputCache) Snapshot() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	snap := snapshot{Version: snapshotVersion, StateToken: []byte(c.stateToken)}
+	for tok, count := range c.validTokens {
+		snap.ValidTokens = append(snap.ValidTokens, snapshotToken{Token: []byte(tok), Count: count})
+	}
+	for id, tok := range c.idsToTokens {
+		snap.IDsToTokens = append(snap.IDsToTokens, snapshotID{TransformID: id.TransformID, SideInputID: id.SideInputID, Token: []byte(tok)})
+	}
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to serialize cache snapshot")
+	}
+	return b, nil
+}
+
+// Restore replaces the valid tokens and the mapping of IDs to tokens of the
+// SideInputCache with those serialized by Snapshot. Restored tokens are valid,
+// so inputs re-populated for them with SetCache are cached as usual. Returns an
+// error if the data is malformed or has an unknown version, or ErrNotInitialized
+// if the cache was never initialized.
+//
+// The concatenated IDs of a version 1 snapshot cannot be split back into their
+// transform and side input IDs, so only its valid tokens are restored; the IDs
+// are remapped when the next bundle validates its tokens.
+func (c *SideInputCache) Restore(data []byte) error {
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return errors.Wrap(err, "failed to deserialize cache snapshot")
+	}
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return errors.Errorf("unsupported cache snapshot version %v", snap.Version)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.initialized() {
+		return newCacheError(ErrNotInitialized, "cannot restore a snapshot into a cache that was never initialized")
+	}
+	c.validTokens = make(map[token]int, len(snap.ValidTokens))
+	c.validSince = make(map[token]time.Time, len(snap.ValidTokens))
+	c.bundleStats = make(map[token]*BundleCacheStats, len(snap.ValidTokens))
+	now := c.now()
+	for _, t := range snap.ValidTokens {
+		c.validTokens[token(t.Token)] = t.Count
+		c.validSince[token(t.Token)] = now
+		c.bundleStats[token(t.Token)] = &BundleCacheStats{PeakBundles: int64(t.Count)}
+	}
+	c.idsToTokens = make(map[CacheKey]token, len(snap.IDsToTokens))
+	c.tokenKeys = make(map[token]map[CacheKey]bool)
+	c.stateToken = token(snap.StateToken)
+	if snap.Version == 1 {
+		return nil
+	}
+	for _, id := range snap.IDsToTokens {
+		c.mapToken(id.TransformID, id.SideInputID, token(id.Token))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	// Tokens are opaque bytes and need not be valid UTF-8.
+	tokTwo := makeRequest("t2", "s2", "\xff\xfe")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetValidTokens(tokTwo)
+	data, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed, got %v", err)
+	}
+
+	var r SideInputCache
+	err = r.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if err := r.Restore(data); err != nil {
+		t.Fatalf("Restore failed, got %v", err)
+	}
+	if !r.isValid("tok1") || !r.isValid("\xff\xfe") {
+		t.Errorf("restored tokens are not valid, got %v", r.validTokens)
+	}
+	if got := r.validTokens["\xff\xfe"]; got != 2 {
+		t.Errorf("restored token count incorrect, expected 2, got %v", got)
+	}
+
+	r.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if output := r.QueryCache("t2", "s2"); output == nil {
+		t.Errorf("call to query cache missed after restore when should have hit")
+	}
+}
+
+func TestRestore_Bad(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if err := s.Restore([]byte("not json")); err == nil {
+		t.Error("Restore succeeded on malformed data but should have failed")
+	}
+	if err := s.Restore([]byte(`{"Version": 99}`)); err == nil {
+		t.Error("Restore succeeded on unknown version but should have failed")
+	}
+}
+
+func TestRestore_Version1(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	// "dG9rMQ==" is the base64 encoding of "tok1".
+	v1 := []byte(`{"Version":1,"ValidTokens":[{"Token":"dG9rMQ==","Count":1}],"IDsToTokens":[{"ID":"t1s1","Token":"dG9rMQ=="}]}`)
+	if err := s.Restore(v1); err != nil {
+		t.Fatalf("Restore of version 1 snapshot failed, got %v", err)
+	}
+	if !s.isValid("tok1") {
+		t.Errorf("restored token is not valid, got %v", s.validTokens)
+	}
+	if len(s.idsToTokens) != 0 {
+		t.Errorf("version 1 ID mappings were restored, got %v", s.idsToTokens)
+	}
+}
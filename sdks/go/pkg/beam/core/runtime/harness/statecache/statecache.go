@@ -21,7 +21,16 @@
 package statecache
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
 	fnpb "github.com/apache/beam/sdks/v2/go/pkg/beam/model/fnexecution_v1"
@@ -29,6 +38,76 @@ import (
 
 type token string
 
+// TokenFromProto extracts the token bytes of a cache token along with the key of the side
+// input it covers. User state tokens cover all cached user state, so the zero key is returned
+// for them. Returns false for token types other than side input and user state. The token
+// is a copy of the proto's bytes, so later changes to them do not affect it.
+func TokenFromProto(ct fnpb.ProcessBundleRequest_CacheToken) (token, CacheKey, bool) {
+	if s := ct.GetSideInput(); s != nil {
+		return token(ct.GetToken()), CacheKey{TransformID: s.GetTransformId(), SideInputID: s.GetSideInputId()}, true
+	}
+	if ct.GetUserState() != nil {
+		return token(ct.GetToken()), CacheKey{}, true
+	}
+	return "", CacheKey{}, false
+}
+
+// DefaultCacheSize is the number of side inputs cached by a SideInputCache initialized
+// with InitDefault. It matches the size used by the SDK harness.
+const DefaultCacheSize = 20
+
+// SizeHintURN is the resource hint through which a pipeline sets the number of side inputs
+// cached by the SDK harness, read by SizeFromResourceHints.
+const SizeHintURN = "beam:resources:go_sideinput_cache_entries"
+
+// SizeFromResourceHints returns the cache capacity set by the SizeHintURN resource hint, for
+// the harness to pass to Init so that pipelines can tune the cache per job. Returns
+// DefaultCacheSize and false if the hint is absent, or is not a positive integer.
+func SizeFromResourceHints(hints map[string]string) (int, bool) {
+	v, ok := hints[SizeHintURN]
+	if !ok {
+		return DefaultCacheSize, false
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size <= 0 {
+		return DefaultCacheSize, false
+	}
+	return size, true
+}
+
+var (
+	// ErrInvalidCapacity is returned when a cache is initialized or resized with a
+	// non-positive capacity or byte limit.
+	ErrInvalidCapacity = errors.New("invalid cache capacity")
+	// ErrAlreadyInitialized is returned when initializing a cache that already holds entries.
+	ErrAlreadyInitialized = errors.New("cache already initialized")
+	// ErrNotInitialized is returned when changing the configuration or state of a cache that
+	// was never initialized.
+	ErrNotInitialized = errors.New("cache not initialized")
+	// ErrTooManyBundles is returned when validating a token would give it more active
+	// bundles than allowed by WithMaxTokenRefcount.
+	ErrTooManyBundles = errors.New("too many bundles using cache token")
+)
+
+// cacheError is an error with its own message that is also an instance of a sentinel
+// error, so callers can check for it with errors.Is.
+type cacheError struct {
+	kind error
+	msg  string
+}
+
+func newCacheError(kind error, format string, args ...interface{}) error {
+	return &cacheError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *cacheError) Error() string {
+	return e.msg
+}
+
+func (e *cacheError) Unwrap() error {
+	return e.kind
+}
+
 // ReusableInput is a resettable value, notably used to unwind iterators cheaply
 // and cache materialized side input across invocations.
 //
@@ -51,177 +130,2142 @@ type ReusableInput interface {
 // the cache will process the list of tokens for cacheable side inputs and
 // be queried when side inputs are requested in bundle execution. Once a
 // new bundle request comes in the valid tokens will be updated and the cache
-// will be re-used. In the event that the cache reaches capacity, a random,
-// currently invalid cached object will be evicted.
+// will be re-used. In the event that the cache reaches capacity, a currently
+// invalid cached object chosen by the eviction policy, by default the least
+// recently used one, will be evicted. Evicted or cleared inputs that
+// implement io.Closer are closed.
+//
+// User state reads may be cached alongside side inputs under the bundle's
+// user state cache token, using QueryUserState and SetUserStateCache. They
+// share capacity, eviction, and token validity with cached side inputs.
+//
+// Every method is safe to call on a cache that was never initialized: tokens
+// are ignored, queries miss, inputs are not cached, and Resize and Restore
+// return ErrNotInitialized.
 type SideInputCache struct {
 	capacity    int
-	mu          sync.Mutex
-	cache       map[token]ReusableInput
-	idsToTokens map[string]token
-	validTokens map[token]int8 // Maps tokens to active bundle counts
+	used        int // Capacity units taken by the cached entries
+	negCap      int // Empty entries cached apart from the capacity when positive
+	negatives   int // Empty entries cached apart from the capacity
+	overflow    int // Entries the cache may exceed capacity by when every entry is in use.
+	evictBatch  int // Entries evicted at least once eviction is needed.
+	mu          sync.RWMutex
+	cache       map[CacheKey]*cacheEntry
+	policy      EvictionPolicy
+	randSource  rand.Source // Set by WithRandSource for the built in random policies
+	byteLimit   int64       // Bounds the cache by total size rather than entry count when positive.
+	sizer       func(ReusableInput) int64
+	copyOnRead  func(ReusableInput) ReusableInput
+	encode      func([]byte) ([]byte, error) // Compresses the bytes of byte inputs when set
+	decode      func([]byte) ([]byte, error)
+	allowStale  bool
+	disabled    bool // Set by InitDisabled so that nothing is cached
+	strict      bool
+	sameToken   func(a, b []byte) bool // Custom token equivalence, byte equality when nil
+	namespace   string
+	backoff     time.Duration    // Retry hint after a first miss, disabled when zero
+	maxBackoff  time.Duration    // Bounds the growth of the retry hint
+	missStreaks map[CacheKey]int // Maps keys to their consecutive misses when backoff is enabled
+	ttl         time.Duration
+	clock       clock // Defaults to the system clock when nil
+	idsToTokens map[CacheKey]token
+	tokenKeys   map[token]map[CacheKey]bool // Reverse index of idsToTokens
+	stateToken  token                       // The most recently validated user state token
+	validTokens map[token]int               // Maps tokens to active bundle counts
+	maxRefs     int                         // Active bundles allowed per token when positive
+	tokenMode   TokenMode
+	validSince  map[token]time.Time // Maps valid tokens to when they last became valid
+	bundleStats map[token]*BundleCacheStats
+	stuckAge    time.Duration
+	evicted     map[CacheKey]token // Maps IDs to the token of their last removed entry
+	onEvict     func(transformID, sideInputID string, in ReusableInput)
+	removed     []*cacheEntry // Entries awaiting the eviction callback
+	secondary   SecondaryCache
+	spilled     map[CacheKey]*cacheEntry // Maps IDs to entries spilled to the secondary, without inputs
+	spills      []*cacheEntry            // Entries awaiting a put to the secondary
+	starveAt    int                      // Consecutive in-use evictions that trigger onStarve
+	onStarve    func()
+	starved     bool       // Whether onStarve is awaiting invocation
+	undersize   *setWindow // Recent set outcomes when WithUnderSizedCallback is set
+	onUnder     func(ratio float64)
+	underDue    bool           // Whether onUnder is awaiting invocation with undersize.ratio()
+	quotas      map[string]int // Maps transform IDs to their soft entry quotas
+	pinned      map[CacheKey]bool
+	veto        func(CacheKey, ReusableInput) bool
+	allowed     map[CacheKey]*cacheEntry // Entries not vetoed, while holding the lock from lockForEviction
+	deferVeto   bool                     // Whether the veto is consulted only once an eviction needs it
+	vetoDue     bool                     // Whether an eviction stopped to consult the veto
+	replacing   map[CacheKey]bool        // Keys kept from eviction while making room for their replacements
+	displaced   *[]CacheKey              // Collects the keys evicted for room during SetCacheEx
+	perTrans    map[string]int           // Maps transform IDs to their number of cached entries
+	eventLog    io.Writer
+	subscribers map[chan CacheEvent]bool   // Channels returned by Subscribe
+	populating  map[CacheKey]*populateCall // In-flight calls of GetOrPopulate
+	tracer      Tracer
+	softCap     int // Entries the background evictor drains down to when positive
+	evictReq    chan struct{}
+	stopEvictor chan struct{}
+	evictorDone chan struct{}
+	janitorTick time.Duration // Interval between janitor sweeps when positive
+	stopJanitor chan struct{}
+	janitorDone chan struct{}
+	flushTick   time.Duration // Interval between calls of onFlush when positive
+	onFlush     func(Stats)
+	stopFlusher chan struct{}
+	flusherDone chan struct{}
+	exporter    *exporter // Set by RegisterMetrics
 	metrics     CacheMetrics
 }
 
+// CacheKey identifies a cached side input by its transform ID and side input ID,
+// or a cached user state read by its transform ID and user state ID. Exactly one
+// of SideInputID and UserStateID is set. LookupKey is only set alongside
+// SideInputID, for the values of one key of a multimap side input.
+type CacheKey struct {
+	Namespace   string // Set by WithNamespace to isolate the entries of a pipeline
+	TransformID string
+	SideInputID string
+	UserStateID string
+	LookupKey   string
+}
+
+// sideInputKey returns the key of the side input in the cache's namespace.
+func (c *SideInputCache) sideInputKey(transformID, sideInputID string) CacheKey {
+	return CacheKey{Namespace: c.namespace, TransformID: transformID, SideInputID: sideInputID}
+}
+
+// multimapKey returns the key of the lookup key of the multimap side input in the cache's
+// namespace.
+func (c *SideInputCache) multimapKey(transformID, sideInputID, lookupKey string) CacheKey {
+	return CacheKey{Namespace: c.namespace, TransformID: transformID, SideInputID: sideInputID, LookupKey: lookupKey}
+}
+
+// userStateKey returns the key of the user state in the cache's namespace.
+func (c *SideInputCache) userStateKey(transformID, userStateID string) CacheKey {
+	return CacheKey{Namespace: c.namespace, TransformID: transformID, UserStateID: userStateID}
+}
+
+// Keys returns the keys of the currently cached inputs, sorted by transform ID, side input ID,
+// lookup key, then user state ID. The keys are a consistent snapshot taken under the read
+// lock, and listing them does not affect the recency of the entries.
+func (c *SideInputCache) Keys() []CacheKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]CacheKey, 0, len(c.cache))
+	for key := range c.cache {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// TokenKeys returns the keys currently mapped to the token by SetValidTokens, sorted as by
+// Keys. A single token may cover several side inputs, all of which become evictable together
+// once the token's bundles complete, at which point the mapping is dropped.
+func (c *SideInputCache) TokenKeys(tok []byte) []CacheKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	t := c.canonical(token(tok))
+	keys := make([]CacheKey, 0, len(c.tokenKeys[t]))
+	for key := range c.tokenKeys[t] {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// sortKeys sorts keys by transform ID, side input ID, lookup key, then user state ID.
+func sortKeys(keys []CacheKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].TransformID != keys[j].TransformID {
+			return keys[i].TransformID < keys[j].TransformID
+		}
+		if keys[i].SideInputID != keys[j].SideInputID {
+			return keys[i].SideInputID < keys[j].SideInputID
+		}
+		if keys[i].LookupKey != keys[j].LookupKey {
+			return keys[i].LookupKey < keys[j].LookupKey
+		}
+		return keys[i].UserStateID < keys[j].UserStateID
+	})
+}
+
+// cacheEntry is a cached input along with the token it was cached under.
+type cacheEntry struct {
+	key      CacheKey
+	tok      token
+	input    ReusableInput
+	size     int64
+	weight   int // Capacity units taken by the entry
+	inserted time.Time
+	accessed time.Time // When the entry was last hit by a query, zero if never
+	hits     int       // Queries that hit the entry since it was cached
+	empty    bool      // Records a side input known to have no value
+	stale    bool      // Records an expired or invalidated entry kept for QueryCacheStale
+}
+
+// CacheMetrics holds the counters describing the effectiveness of a SideInputCache.
 type CacheMetrics struct {
-	Hits           int64
-	Misses         int64
-	Evictions      int64
-	InUseEvictions int64
+	Hits                      int64
+	Misses                    int64
+	CapacityEvictions         int64 // Entries evicted to make room for new inputs
+	InUseEvictions            int64
+	BytesInUse                int64
+	CompleteBundles           int64
+	Expirations               int64 // Expired entries evicted; those kept as stale are counted once evicted for capacity
+	Flushes                   int64 // Entries dropped by Clear
+	QuotaEvictions            int64 // Evictions of over-quota transforms' entries, also counted in CapacityEvictions
+	ManualInvalidations       int64
+	PressureEvictions         int64 // Entries evicted by EvictFraction
+	SecondaryHits             int64 // Queries served from the secondary cache, also counted in Hits
+	CapacityShortfall         int64 // Calls to SetValidTokens validating more distinct side inputs than the capacity
+	InitFailures              int64 // Entries removed by QueryCacheWithInit since their input failed to initialize
+	SupersededEvictions       int64 // Entries removed by a query since their side input is now valid under another token
+	DecodeFailures            int64 // Entries removed since the value codec failed to decode their input
+	UncompressedBytes         int64 // Bytes of byte inputs cached compressed by the value codec, before compression
+	CompressedBytes           int64 // Bytes of byte inputs cached compressed by the value codec, after compression
+	NilRejections             int64 // Nil inputs passed to be cached, which are never cached
+	DroppedEvents             int64 // Events not delivered to a subscriber lagging behind
+	VetoedEvictions           int64 // Inputs not cached since the eviction veto kept entries that could make room
+	StuckTokens               int64 // Tokens valid for longer than the WithStuckTokenAge threshold, computed when read
+	OversizedRejections       int64 // Inputs larger than the whole byte limit or heavier than the whole capacity
+	PeakEntries               int64 // Most entries cached at once
+	PeakBytes                 int64 // Most bytes in use at once
+	UnbalancedCompletions     int64 // Completions of tokens that had no active bundle
+	ConsecutiveInUseEvictions int64 // In-use evictions since an input was last cached
+	LifetimeSamples           int64 // Evicted or expired entries whose age is summed in TotalLifetime
+	TotalLifetime             time.Duration
+	TotalEvictions            int64 // Sum of capacity and pressure evictions, expirations, manual invalidations, superseded entries, init and decode failures, and flushes, computed when read
+	PinnedEntries             int64 // Cached entries exempted from eviction by Pin, computed when read
+}
+
+// AverageEntryLifetime returns the mean time entries were cached before being evicted or
+// expiring, or zero if none have been. Short lifetimes alongside many evictions suggest the
+// cache is too small for its workload.
+func (m CacheMetrics) AverageEntryLifetime() time.Duration {
+	if m.LifetimeSamples == 0 {
+		return 0
+	}
+	return m.TotalLifetime / time.Duration(m.LifetimeSamples)
+}
+
+// Metrics returns a copy of the current metrics of the SideInputCache. Every counter is only
+// updated while holding the write lock, so the copy is a consistent snapshot and Metrics is
+// safe to call concurrently with any other method.
+func (c *SideInputCache) Metrics() CacheMetrics {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.currentMetrics()
+}
+
+// KeyStats returns the number of queries that hit each cached entry since it was cached, to
+// find the side inputs dominating the cache's traffic. Counts start afresh when an input is
+// cached again after being evicted or replaced.
+func (c *SideInputCache) KeyStats() map[CacheKey]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := make(map[CacheKey]int, len(c.cache))
+	for key, entry := range c.cache {
+		stats[key] = entry.hits
+	}
+	return stats
+}
+
+// LastAccess returns when the cached input for the transform ID and side input ID was last hit
+// by a query, or false if it is not cached or has not been hit since it was cached. It is meant
+// for debugging why an input was evicted, and does not affect the recency of the entry.
+func (c *SideInputCache) LastAccess(transformID, sideInputID string) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.cache[c.sideInputKey(transformID, sideInputID)]
+	if !ok || entry.accessed.IsZero() {
+		return time.Time{}, false
+	}
+	return entry.accessed, true
+}
+
+// Len returns the number of entries currently cached.
+func (c *SideInputCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.cache)
+}
+
+// Cap returns the configured capacity of the cache in entries, or zero for a cache bounded by
+// bytes rather than entries.
+func (c *SideInputCache) Cap() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.byteLimit > 0 {
+		return 0
+	}
+	return c.capacity
+}
+
+// Utilization returns how full the cache is as a fraction of its capacity, or of its byte
+// limit for a cache bounded by bytes, so that monitoring can alert on fullness without
+// knowing the configured size. Weighted entries count by their weight. The fraction may
+// exceed 1 for a cache using WithOverflowBuffer, and is zero for an uninitialized cache.
+func (c *SideInputCache) Utilization() float64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.utilization()
+}
+
+// utilization returns the fraction reported by Utilization. It should only be called by a
+// goroutine holding the lock.
+func (c *SideInputCache) utilization() float64 {
+	if c.byteLimit > 0 {
+		return float64(c.metrics.BytesInUse) / float64(c.byteLimit)
+	}
+	if c.capacity <= 0 {
+		return 0
+	}
+	return float64(c.used) / float64(c.capacity)
+}
+
+// Stats gathers the occupancy, configuration, and counters of a SideInputCache at one instant.
+type Stats struct {
+	Entries     int     // Cached entries, including empty ones
+	Capacity    int     // Capacity in entries, zero for a cache bounded by bytes
+	ByteLimit   int64   // Limit on the bytes in use, zero for a cache bounded by entries
+	Utilization float64 // As reported by Utilization
+	HitRatio    float64 // Fraction of queries that hit, zero before any query
+	Metrics     CacheMetrics
+}
+
+// Stats returns a consistent snapshot of everything known about the cache's effectiveness,
+// for a debug handler or a periodic log line. The metrics hold the hits, misses, breakdown of
+// evictions, peaks, and bytes in use, as returned by Metrics.
+func (c *SideInputCache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	st := Stats{
+		Entries:     len(c.cache),
+		ByteLimit:   c.byteLimit,
+		Utilization: c.utilization(),
+		Metrics:     c.currentMetrics(),
+	}
+	if c.byteLimit <= 0 {
+		st.Capacity = c.capacity
+	}
+	if queries := st.Metrics.Hits + st.Metrics.Misses; queries > 0 {
+		st.HitRatio = float64(st.Metrics.Hits) / float64(queries)
+	}
+	return st
+}
+
+// EstimatedBytes returns a best-effort estimate of the memory held by the cached inputs, summing
+// the estimates of the inputs implementing Sizer. Inputs not implementing it are not counted,
+// so the estimate is partial unless every cached input does. Unlike BytesInUse, it does not
+// require the cache to be bounded by bytes.
+func (c *SideInputCache) EstimatedBytes() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var total int64
+	for _, entry := range c.cache {
+		if s, ok := entry.input.(Sizer); ok && !entry.empty {
+			total += s.EstimatedBytes()
+		}
+	}
+	return total
+}
+
+// currentMetrics returns a copy of the metrics with the computed fields filled in. It should
+// only be called by a goroutine holding the lock.
+func (c *SideInputCache) currentMetrics() CacheMetrics {
+	m := c.metrics
+	m.StuckTokens = c.countStuckTokens()
+	m.TotalEvictions = m.totalEvictions()
+	m.PinnedEntries = c.countPinned()
+	return m
+}
+
+// totalEvictions returns the sum of the counters of every kind of removal from the cache.
+func (m CacheMetrics) totalEvictions() int64 {
+	return m.CapacityEvictions + m.PressureEvictions + m.Expirations + m.ManualInvalidations + m.SupersededEvictions + m.InitFailures + m.DecodeFailures + m.Flushes
+}
+
+// countStuckTokens returns the number of tokens that have been valid for longer
+// than the stuck token age, or zero if no age is configured.
+func (c *SideInputCache) countStuckTokens() int64 {
+	if c.stuckAge <= 0 {
+		return 0
+	}
+	var n int64
+	for _, since := range c.validSince {
+		if c.now().Sub(since) > c.stuckAge {
+			n++
+		}
+	}
+	return n
+}
+
+// BundleCacheStats holds the counters of a SideInputCache attributable to the bundles using
+// a single cache token.
+type BundleCacheStats struct {
+	Hits        int64
+	Misses      int64
+	Evictions   int64 // Entries evicted to make room for inputs set under the token
+	PeakBundles int64 // Most bundles using the token at once
+}
+
+// BundleStats returns a copy of the counters for the currently valid token, or zero counters
+// if the token is not valid. Counting starts when the token becomes valid in SetValidTokens and
+// the counters are dropped once CompleteBundle completes its last bundle, so stats for a
+// progress report should be read before completing the bundle.
+func (c *SideInputCache) BundleStats(tok []byte) BundleCacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if st, ok := c.bundleStats[c.canonical(token(tok))]; ok {
+		return *st
+	}
+	return BundleCacheStats{}
+}
+
+// TokenRefCount describes a currently valid token and its number of active bundles.
+type TokenRefCount struct {
+	Token []byte
+	Count int
+	Peak  int       // Most active bundles at once since the token last became valid.
+	Since time.Time // When the token last became valid.
+}
+
+// TokenRefCounts returns the currently valid tokens with their active bundle counts, sorted
+// from the longest valid. A token remaining valid long after its bundles should have
+// finished indicates a missed call to CompleteBundle, which leaves its entries unevictable.
+func (c *SideInputCache) TokenRefCounts() []TokenRefCount {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	counts := make([]TokenRefCount, 0, len(c.validTokens))
+	for tok, count := range c.validTokens {
+		counts = append(counts, TokenRefCount{Token: []byte(tok), Count: count, Peak: int(c.bundleStats[tok].PeakBundles), Since: c.validSince[tok]})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Since.Before(counts[j].Since)
+	})
+	return counts
+}
+
+// ResetMetrics zeroes the counters of the SideInputCache, leaving cached inputs and
+// tokens intact. Gauges describing the current contents of the cache, such as
+// BytesInUse, are preserved, and the peaks restart from the current contents.
+func (c *SideInputCache) ResetMetrics() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = CacheMetrics{
+		BytesInUse:  c.metrics.BytesInUse,
+		PeakEntries: int64(len(c.cache)),
+		PeakBytes:   c.metrics.BytesInUse,
+	}
+	if c.exporter != nil {
+		// Registered counters keep counting from their totals.
+		c.exporter.last = c.metrics
+	}
 }
 
 // Init makes the cache map and the map of IDs to cache tokens for the
 // SideInputCache. Should only be called once. Returns an error for
-// non-positive capacities.
-func (c *SideInputCache) Init(cap int) error {
+// non-positive capacities, or if the cache was already initialized and
+// holds entries, since they would otherwise be silently dropped. Use
+// Reinit to deliberately clear and resize an initialized cache. Background
+// goroutines started by an earlier initialization are stopped.
+func (c *SideInputCache) Init(cap int, opts ...Option) error {
 	if cap <= 0 {
-		return errors.Errorf("capacity must be a positive integer, got %v", cap)
+		return newCacheError(ErrInvalidCapacity, "capacity must be a positive integer, got %v", cap)
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.cache = make(map[token]ReusableInput, cap)
-	c.idsToTokens = make(map[string]token)
-	c.validTokens = make(map[token]int8)
+	if err := c.checkUninitialized(); err != nil {
+		return err
+	}
+	c.stopWorkers()
+	c.initMaps(cap)
+	c.policy = NewLRUPolicy()
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.seedPolicy()
 	c.capacity = cap
+	c.startJanitor()
+	c.startFlusher()
 	return nil
 }
 
-// SetValidTokens clears the list of valid tokens then sets new ones, also updating the mapping of
-// transform and side input IDs to cache tokens in the process. Should be called at the start of every
-// new ProcessBundleRequest. If the runner does not support caching, the passed cache token values
-// should be empty and all get/set requests will silently be no-ops.
-func (c *SideInputCache) SetValidTokens(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) {
+// InitDefault behaves like Init with a capacity of DefaultCacheSize, for callers without a
+// better informed size.
+func (c *SideInputCache) InitDefault(opts ...Option) error {
+	return c.Init(DefaultCacheSize, opts...)
+}
+
+// InitDisabled initializes the cache with caching disabled, so that operators may turn
+// caching off through configuration without special casing every call site. Tokens are
+// tracked as usual, but inputs are never cached, so every query misses and is counted by the
+// Misses metric. Init deliberately rejects a zero capacity rather than disabling the cache,
+// so that caching is never disabled by accident. Reinit enables caching. Returns an error if
+// the cache was already initialized and holds entries.
+func (c *SideInputCache) InitDisabled(opts ...Option) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for _, tok := range cacheTokens {
-		// User State caching is currently not supported, so these tokens are ignored
-		if tok.GetUserState() != nil {
-			continue
-		}
-		s := tok.GetSideInput()
-		transformID := s.GetTransformId()
-		sideInputID := s.GetSideInputId()
-		t := token(tok.GetToken())
-		c.setValidToken(transformID, sideInputID, t)
+	if err := c.checkUninitialized(); err != nil {
+		return err
+	}
+	c.stopWorkers()
+	c.initMaps(0)
+	c.policy = NewLRUPolicy()
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.seedPolicy()
+	c.disabled = true
+	c.startFlusher()
+	return nil
 }
 
-// setValidToken adds a new valid token for a request into the SideInputCache struct
-// by mapping the transform ID and side input ID pairing to the cache token.
-func (c *SideInputCache) setValidToken(transformID, sideInputID string, tok token) {
-	idKey := transformID + sideInputID
-	c.idsToTokens[idKey] = tok
-	count, ok := c.validTokens[tok]
-	if !ok {
-		c.validTokens[tok] = 1
-	} else {
-		c.validTokens[tok] = count + 1
+// InitWithPolicy behaves like Init, using the given EvictionPolicy to choose which
+// entries are evicted in place of the default LRU policy. The policy must not be
+// shared with another SideInputCache.
+func (c *SideInputCache) InitWithPolicy(cap int, policy EvictionPolicy, opts ...Option) error {
+	if policy == nil {
+		return errors.New("eviction policy must be non-nil")
+	}
+	if err := c.Init(cap, opts...); err != nil {
+		return err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = policy
+	return nil
 }
 
-// CompleteBundle takes the cache tokens passed to set the valid tokens and decrements their
-// usage count for the purposes of maintaining a valid count of whether or not a value is
-// still in use. Should be called once ProcessBundle has completed.
-func (c *SideInputCache) CompleteBundle(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) {
+// InitWithByteLimit makes the cache maps for a SideInputCache that is bounded by
+// the total size of its cached inputs, as reported by sizer, rather than by the
+// number of entries. Should only be called once, in place of Init. Returns an
+// error for non-positive limits, a nil sizer, or if the cache was already
+// initialized and holds entries.
+func (c *SideInputCache) InitWithByteLimit(maxBytes int64, sizer func(ReusableInput) int64, opts ...Option) error {
+	if maxBytes <= 0 {
+		return newCacheError(ErrInvalidCapacity, "byte limit must be a positive integer, got %v", maxBytes)
+	}
+	if sizer == nil {
+		return errors.New("sizer must be non-nil")
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for _, tok := range cacheTokens {
-		// User State caching is currently not supported, so these tokens are ignored
-		if tok.GetUserState() != nil {
-			continue
+	if err := c.checkUninitialized(); err != nil {
+		return err
+	}
+	c.stopWorkers()
+	c.initMaps(0)
+	c.policy = NewLRUPolicy()
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.seedPolicy()
+	c.byteLimit = maxBytes
+	c.sizer = sizer
+	c.startJanitor()
+	c.startFlusher()
+	return nil
+}
+
+// Reinit clears the cache as with Clear and sets its capacity to the given number of entries,
+// as if it had been initialized with Init. Other configuration, such as options and the
+// eviction policy, is kept, though a byte limit set by InitWithByteLimit is replaced. Returns
+// an error for non-positive capacities, in which case the cache is left unchanged.
+func (c *SideInputCache) Reinit(cap int) error {
+	if cap <= 0 {
+		return newCacheError(ErrInvalidCapacity, "capacity must be a positive integer, got %v", cap)
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	if c.policy == nil {
+		c.policy = NewLRUPolicy()
+	}
+	c.capacity = cap
+	c.byteLimit = 0
+	c.sizer = nil
+	c.disabled = false
+	c.clear()
+	return nil
+}
+
+// Resize changes the capacity of the cache without dropping entries that still fit. Growing the
+// cache never evicts. When shrinking below the current number of entries, entries that are not
+// currently valid are evicted in the order chosen by the eviction policy until the cache fits;
+// if too many entries are still in use, the remainder are evicted by later calls to SetCache
+// once they become evictable. Returns an error for non-positive capacities, or if the cache is
+// bounded by bytes rather than entries.
+func (c *SideInputCache) Resize(cap int) error {
+	if cap <= 0 {
+		return newCacheError(ErrInvalidCapacity, "capacity must be a positive integer, got %v", cap)
+	}
+	var err error
+	c.withEvictionLock(func() {
+		if !c.initialized() {
+			err = newCacheError(ErrNotInitialized, "cannot resize a cache that was never initialized")
+			return
 		}
-		t := token(tok.GetToken())
-		c.decrementTokenCount(t)
+		if c.byteLimit > 0 {
+			err = errors.New("cannot resize a cache bounded by bytes")
+			return
+		}
+		if c.disabled {
+			err = errors.New("cannot resize a disabled cache; use Reinit to enable it")
+			return
+		}
+		c.capacity = cap
+		c.makeRoom(0, 0)
+	})
+	return err
+}
+
+// EvictionOrder returns the keys of the cached entries that may be evicted, in the order
+// in which they would be chosen to make room for new inputs, to inspect the eviction policy
+// while tuning. Entries in use or pinned are excluded, and entries of transforms over their
+// quota come first. For policies choosing victims at random, the order is one of those
+// possible. Recency is not updated, but as choosing a victim may advance the random source of
+// a policy, EvictionOrder takes the write lock.
+func (c *SideInputCache) EvictionOrder() []CacheKey {
+	c.lockForEviction()
+	defer c.unlock()
+	if !c.initialized() {
+		return nil
+	}
+	var order []CacheKey
+	chosen := make(map[CacheKey]bool)
+	perTrans := make(map[string]int, len(c.quotas))
+	for transformID := range c.quotas {
+		perTrans[transformID] = c.perTrans[transformID]
+	}
+	candidate := func(key CacheKey) bool {
+		return !chosen[key] && c.evictable(key)
 	}
+	overQuota := func(key CacheKey) bool {
+		quota, ok := c.quotas[key.TransformID]
+		return ok && perTrans[key.TransformID] > quota && candidate(key)
+	}
+	for _, pick := range []func(CacheKey) bool{overQuota, candidate} {
+		for {
+			key, ok := c.policy.Victim(pick)
+			if !ok {
+				break
+			}
+			chosen[key] = true
+			perTrans[key.TransformID]--
+			order = append(order, key)
+		}
+	}
+	return order
 }
 
-// decrementTokenCount decrements the validTokens entry for
-// a given token by 1. Should only be called when completing
-// a bundle.
-func (c *SideInputCache) decrementTokenCount(tok token) {
-	count := c.validTokens[tok]
-	if count == 1 {
-		delete(c.validTokens, tok)
-	} else {
-		c.validTokens[tok] = count - 1
+// EvictFraction evicts the given fraction of the currently evictable entries, rounded up, in
+// the order chosen by the eviction policy, and returns the number of entries evicted. Entries
+// that are in use or pinned are never evicted. It lets an external memory monitor reclaim
+// memory under pressure; the cache never polls memory usage itself. Fractions are clamped to
+// the range [0, 1].
+func (c *SideInputCache) EvictFraction(f float64) int {
+	c.lockForEviction()
+	defer c.unlock()
+	if f <= 0 {
+		return 0
+	}
+	if f > 1 {
+		f = 1
+	}
+	var candidates int
+	for key := range c.cache {
+		if c.evictable(key) {
+			candidates++
+		}
+	}
+	n := int(math.Ceil(f * float64(candidates)))
+	for i := 0; i < n; i++ {
+		key, ok := c.policy.Victim(c.evictable)
+		if !ok {
+			return i
+		}
+		c.evictForRoom(c.cache[key])
+		c.metrics.PressureEvictions++
 	}
+	return n
 }
 
-func (c *SideInputCache) makeAndValidateToken(transformID, sideInputID string) (token, bool) {
-	idKey := transformID + sideInputID
-	// Check if it's a known token
-	tok, ok := c.idsToTokens[idKey]
-	if !ok {
-		return "", false
+// SetStrictMode turns the strict mode set by WithStrictMode on or off. Unlike the option, it
+// may be called on the zero value, so that using the cache before Init panics as well.
+func (c *SideInputCache) SetStrictMode(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.strict = on
+}
+
+// checkInitialized panics in strict mode if the cache was never initialized. It should only be
+// called by a goroutine holding the lock.
+func (c *SideInputCache) checkInitialized(op string) {
+	if c.strict && !c.initialized() {
+		panic(fmt.Sprintf("statecache: %v called before Init", op))
 	}
-	return tok, c.isValid(tok)
 }
 
-// QueryCache takes a transform ID and side input ID and checking if a corresponding side
-// input has been cached. A query having a bad token (e.g. one that doesn't make a known
-// token or one that makes a known but currently invalid token) is treated the same as a
-// cache miss.
-func (c *SideInputCache) QueryCache(transformID, sideInputID string) ReusableInput {
+// checkUninitialized returns an error if the cache was already initialized and
+// holds entries, or panics in strict mode if it was initialized at all.
+func (c *SideInputCache) checkUninitialized() error {
+	if c.strict && c.cache != nil {
+		panic(fmt.Sprintf("statecache: cache initialized twice, holding %v entries; use Reinit to clear and resize it", len(c.cache)))
+	}
+	if len(c.cache) > 0 {
+		return newCacheError(ErrAlreadyInitialized, "cache already initialized and holding %v entries", len(c.cache))
+	}
+	return nil
+}
+
+// initialized reports whether the cache was initialized by one of the Init methods or Reinit.
+func (c *SideInputCache) initialized() bool {
+	return c.cache != nil
+}
+
+func (c *SideInputCache) initMaps(cap int) {
+	c.cache = make(map[CacheKey]*cacheEntry, cap)
+	c.idsToTokens = make(map[CacheKey]token)
+	c.tokenKeys = make(map[token]map[CacheKey]bool)
+	c.validTokens = make(map[token]int)
+	c.validSince = make(map[token]time.Time)
+	c.bundleStats = make(map[token]*BundleCacheStats)
+	c.evicted = make(map[CacheKey]token)
+	c.perTrans = make(map[string]int)
+	c.missStreaks = make(map[CacheKey]int)
+	c.spilled = make(map[CacheKey]*cacheEntry)
+}
+
+// SetTransformQuota sets a soft quota on the number of entries cached for the given
+// transform. When the cache must evict, evictable entries of transforms over their quota
+// are chosen before the least recently used entries of other transforms. A non-positive
+// maxEntries removes the quota.
+func (c *SideInputCache) SetTransformQuota(transformID string, maxEntries int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	tok, ok := c.makeAndValidateToken(transformID, sideInputID)
-	if !ok {
-		return nil
+	if maxEntries <= 0 {
+		delete(c.quotas, transformID)
+		return
 	}
-	// Check to see if cached
-	input, ok := c.cache[tok]
-	if !ok {
-		c.metrics.Misses++
-		return nil
+	if c.quotas == nil {
+		c.quotas = make(map[string]int)
 	}
+	c.quotas[transformID] = maxEntries
+}
 
-	c.metrics.Hits++
-	return input
+// Pin exempts the side input for the transform ID and side input ID from eviction, so that
+// small reference inputs stay cached regardless of recency or whether their token is still
+// valid. Pinned entries still count against capacity, so a cache holding only pinned and
+// in-use entries cannot cache new inputs. Pinning applies to the side input whether or not it
+// is currently cached, and lasts until Unpin. Pinned entries still expire with a TTL and are
+// removed by Invalidate and Clear.
+func (c *SideInputCache) Pin(transformID, sideInputID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pinned == nil {
+		c.pinned = make(map[CacheKey]bool)
+	}
+	c.pinned[c.sideInputKey(transformID, sideInputID)] = true
 }
 
-// SetCache allows a user to place a ReusableInput materialized from the reader into the SideInputCache
-// with its corresponding transform ID and side input ID. If the IDs do not pair with a known, valid token
-// then we silently do not cache the input, as this is an indication that the runner is treating that input
-// as uncacheable.
-func (c *SideInputCache) SetCache(transformID, sideInputID string, input ReusableInput) {
+// Unpin makes a side input pinned by Pin evictable again.
+func (c *SideInputCache) Unpin(transformID, sideInputID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	tok, ok := c.makeAndValidateToken(transformID, sideInputID)
-	if !ok {
+	delete(c.pinned, c.sideInputKey(transformID, sideInputID))
+}
+
+// countPinned returns the number of cached entries that are pinned.
+func (c *SideInputCache) countPinned() int64 {
+	var n int64
+	for key := range c.pinned {
+		if _, ok := c.cache[key]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// overQuota reports whether the transform has more entries cached than its quota.
+func (c *SideInputCache) overQuota(transformID string) bool {
+	quota, ok := c.quotas[transformID]
+	return ok && c.perTrans[transformID] > quota
+}
+
+// Clear drops every cached input along with all valid tokens and the mapping of
+// IDs to tokens, leaving an empty cache with the configured capacity. Useful when
+// a worker is being recycled or a pipeline is draining.
+func (c *SideInputCache) Clear() {
+	c.mu.Lock()
+	defer c.unlock()
+	if !c.initialized() {
 		return
 	}
-	if len(c.cache) >= c.capacity {
-		c.evictElement()
+	c.clear()
+}
+
+// clear drops every cached input and token. It should only be called by a
+// goroutine holding the write lock.
+func (c *SideInputCache) clear() {
+	c.metrics.Flushes += int64(len(c.cache))
+	for _, entry := range c.cache {
+		c.policy.Remove(entry.key)
+		c.logEvent("flush", entry.key, entry.tok)
+		c.queueRemoved(entry)
 	}
-	c.cache[tok] = input
+	c.metrics.BytesInUse = 0
+	c.used = 0
+	c.negatives = 0
+	c.stateToken = ""
+	c.initMaps(c.capacity)
 }
 
-func (c *SideInputCache) isValid(tok token) bool {
-	count, ok := c.validTokens[tok]
-	// If the token is not known or not in use, return false
-	return ok && count > 0
+// SetValidTokens clears the list of valid tokens then sets new ones, also updating the mapping of
+// transform and side input IDs to cache tokens in the process. Should be called at the start of every
+// new ProcessBundleRequest. If the runner does not support caching, the passed cache token values
+// should be empty and all get/set requests will silently be no-ops. A token repeated within one
+// call, such as one shared by several side inputs, counts as a single active bundle, while one
+// already valid counts as another as set by SetValidTokensMode. A user state token becomes the
+// token for all cached user state. Tokens of neither type are skipped; the number of tokens
+// applied is returned. A bundle validating more distinct side inputs than the capacity of a cache
+// bounded by entries can never have them cached at once, so it counts as a capacity shortfall in
+// the metrics, signaling that the cache is misconfigured. If the call would give a token more
+// active bundles than allowed by WithMaxTokenRefcount, no token is applied; use TrySetValidTokens
+// to learn of the rejection.
+func (c *SideInputCache) SetValidTokens(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) int {
+	applied, _ := c.TrySetValidTokens(cacheTokens...)
+	return applied
+}
+
+// TrySetValidTokens behaves like SetValidTokens, returning an error wrapping
+// ErrTooManyBundles, with no token applied, if the call would give a token more active
+// bundles than allowed by WithMaxTokenRefcount.
+func (c *SideInputCache) TrySetValidTokens(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.initialized() {
+		return 0, nil
+	}
+	if err := c.checkRefcounts(cacheTokens); err != nil {
+		return 0, err
+	}
+	return c.validate(cacheTokens), nil
 }
 
-// evictElement randomly evicts a ReusableInput that is not currently valid from the cache.
-// It should only be called by a goroutine that obtained the lock in SetCache.
-func (c *SideInputCache) evictElement() {
-	deleted := false
-	// Select a key from the cache at random
-	for k := range c.cache {
-		// Do not evict an element if it's currently valid
-		if !c.isValid(k) {
-			delete(c.cache, k)
-			c.metrics.Evictions++
-			deleted = true
-			break
+// validate applies the tokens as described by SetValidTokens, returning the number applied.
+// It should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) validate(cacheTokens []fnpb.ProcessBundleRequest_CacheToken) int {
+	// Pre-size the maps for the first bundle rather than growing them one token at a time.
+	// Bundles with few tokens, commonly a single side input, reuse the emptied maps instead,
+	// so that bundles processed one after another do not reallocate them every time.
+	if len(c.idsToTokens) == 0 && len(cacheTokens) > presizeTokens {
+		c.idsToTokens = make(map[CacheKey]token, len(cacheTokens))
+		c.tokenKeys = make(map[token]map[CacheKey]bool, len(cacheTokens))
+	}
+	if len(c.validTokens) == 0 && len(cacheTokens) > presizeTokens {
+		c.validTokens = make(map[token]int, len(cacheTokens))
+		c.validSince = make(map[token]time.Time, len(cacheTokens))
+		c.bundleStats = make(map[token]*BundleCacheStats, len(cacheTokens))
+	}
+	seen := make(map[token]bool, len(cacheTokens))
+	keys := make(map[CacheKey]bool, len(cacheTokens))
+	applied := 0
+	for _, tok := range cacheTokens {
+		t, key, ok := TokenFromProto(tok)
+		if !ok {
+			// Tokens that carry no type at all are ignored.
+			continue
+		}
+		t = c.canonical(t)
+		if tok.GetUserState() != nil {
+			c.stateToken = t
+			c.logEvent("validate", CacheKey{}, t)
+		} else {
+			c.mapToken(key.TransformID, key.SideInputID, t)
+			keys[key] = true
+		}
+		if !seen[t] {
+			seen[t] = true
+			if c.tokenMode == IncrementMode || !c.isValid(t) {
+				c.incrementTokenCount(t)
+			}
 		}
+		applied++
 	}
-	// Nothing is deleted if every side input is still valid. Clear
-	// out a random entry and record the in-use eviction
-	if !deleted {
-		for k := range c.cache {
-			delete(c.cache, k)
-			c.metrics.InUseEvictions++
-			break
+	if c.byteLimit <= 0 && !c.disabled && len(keys) > c.capacity {
+		c.metrics.CapacityShortfall++
+	}
+	return applied
+}
+
+// checkRefcounts returns an error if validating the tokens would give one of them more active
+// bundles than allowed by WithMaxTokenRefcount. It should only be called by a goroutine
+// holding the write lock.
+func (c *SideInputCache) checkRefcounts(cacheTokens []fnpb.ProcessBundleRequest_CacheToken) error {
+	if c.maxRefs <= 0 {
+		return nil
+	}
+	seen := make(map[token]bool, len(cacheTokens))
+	for _, tok := range cacheTokens {
+		t, _, ok := TokenFromProto(tok)
+		if !ok {
+			continue
+		}
+		t = c.canonical(t)
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if c.tokenMode == IdempotentMode && c.isValid(t) {
+			continue
+		}
+		if count := c.validTokens[t]; count >= c.maxRefs {
+			return newCacheError(ErrTooManyBundles, "cache token %q already used by %v bundles, the most allowed", t, count)
 		}
 	}
+	return nil
+}
+
+// presizeTokens is the number of tokens a bundle may validate without the token maps being
+// reallocated to fit them when empty, which is as many as a map holds without growing.
+const presizeTokens = 8
+
+// TokenMode selects how SetValidTokens treats a token that is already valid.
+type TokenMode int
+
+const (
+	// IncrementMode counts every call to SetValidTokens as a new bundle using its tokens,
+	// so a token stays valid until CompleteBundle has been called as many times. It is the
+	// default, and the mode the SDK harness should use, as it validates the tokens of each
+	// ProcessBundleRequest once and completes them once the bundle finishes.
+	IncrementMode TokenMode = iota
+	// IdempotentMode treats validating an already valid token as a retry of the same
+	// bundle, leaving its count of active bundles unchanged, so a single CompleteBundle
+	// completes it however many times it was validated.
+	IdempotentMode
+)
+
+// SetValidTokensMode sets how later calls to SetValidTokens treat tokens that are already
+// valid. Tokens repeated within a single call count once in either mode.
+func (c *SideInputCache) SetValidTokensMode(mode TokenMode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokenMode = mode
+}
+
+// setValidToken adds a new valid token for a request into the SideInputCache struct
+// by mapping the transform ID and side input ID pairing to the cache token.
+func (c *SideInputCache) setValidToken(transformID, sideInputID string, tok token) {
+	c.mapToken(transformID, sideInputID, tok)
+	c.incrementTokenCount(tok)
+}
+
+// mapToken maps the transform ID and side input ID pairing to the cache token.
+func (c *SideInputCache) mapToken(transformID, sideInputID string, tok token) {
+	key := c.sideInputKey(transformID, sideInputID)
+	c.unmapKey(key)
+	c.idsToTokens[key] = tok
+	keys, ok := c.tokenKeys[tok]
+	if !ok {
+		keys = make(map[CacheKey]bool)
+		c.tokenKeys[tok] = keys
+	}
+	keys[key] = true
+	c.logEvent("validate", key, tok)
+}
+
+// unmapKey forgets the token the key is mapped to, if any.
+func (c *SideInputCache) unmapKey(key CacheKey) {
+	tok, ok := c.idsToTokens[key]
+	if !ok {
+		return
+	}
+	delete(c.idsToTokens, key)
+	keys := c.tokenKeys[tok]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(c.tokenKeys, tok)
+	}
+}
+
+// incrementTokenCount increments the validTokens entry for a given token by 1.
+func (c *SideInputCache) incrementTokenCount(tok token) {
+	count, ok := c.validTokens[tok]
+	if !ok {
+		c.validSince[tok] = c.now()
+		c.bundleStats[tok] = &BundleCacheStats{}
+	}
+	c.validTokens[tok] = count + 1
+	if st := c.bundleStats[tok]; int64(count+1) > st.PeakBundles {
+		st.PeakBundles = int64(count + 1)
+	}
+}
+
+// CompleteBundle takes the cache tokens passed to set the valid tokens and decrements their
+// usage count for the purposes of maintaining a valid count of whether or not a value is
+// still in use. Should be called once ProcessBundle has completed. As in SetValidTokens, a token
+// repeated within one call is decremented once.
+func (c *SideInputCache) CompleteBundle(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.initialized() {
+		return
+	}
+	seen := make(map[token]bool, len(cacheTokens))
+	for _, tok := range cacheTokens {
+		t, _, ok := TokenFromProto(tok)
+		// Tokens that carry no type at all were never validated, so these are ignored
+		if !ok {
+			continue
+		}
+		t = c.canonical(t)
+		if !seen[t] {
+			seen[t] = true
+			c.decrementTokenCount(t)
+		}
+	}
+	c.metrics.CompleteBundles++
+}
+
+// CompleteBundles completes several bundles in a single locked pass, such as when a worker
+// tears down overlapping bundles at once. Unlike CompleteBundle, every occurrence of a token
+// is decremented, as each is taken to belong to a different bundle, and each counts as a
+// completed bundle in the metrics. The eviction eligibility of the tokens thus changes
+// atomically for later calls.
+func (c *SideInputCache) CompleteBundles(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.initialized() {
+		return
+	}
+	for _, tok := range cacheTokens {
+		t, _, ok := TokenFromProto(tok)
+		// Tokens that carry no type at all were never validated, so these are ignored
+		if !ok {
+			continue
+		}
+		t = c.canonical(t)
+		c.decrementTokenCount(t)
+		c.metrics.CompleteBundles++
+	}
+}
+
+// ResetForNewBundle releases every currently valid token, as if all of their bundles had
+// completed, then validates the given tokens as SetValidTokens would. It suits a worker reused
+// for a new ProcessBundleRequest after a bundle crashed without calling CompleteBundle, whose
+// leaked tokens would otherwise keep their entries in use indefinitely. Tokens also passed in
+// the new request are released too, restarting them with a single active bundle. As the
+// tokens of other bundles are released as well, it must only be called when no other bundle
+// is running. The cache cannot tell the tokens of a crashed bundle from those of a running one,
+// but in strict mode it panics if a token is held by more than one bundle, since then another
+// bundle is still running. Returns the number of tokens released.
+func (c *SideInputCache) ResetForNewBundle(cacheTokens ...fnpb.ProcessBundleRequest_CacheToken) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.initialized() {
+		return 0
+	}
+	if c.strict {
+		for tok, count := range c.validTokens {
+			if count > 1 {
+				panic(fmt.Sprintf("statecache: bundle reset while token %q is held by %v bundles", string(tok), count))
+			}
+		}
+	}
+	reaped := len(c.validTokens)
+	for tok := range c.validTokens {
+		c.releaseToken(tok)
+	}
+	c.validate(cacheTokens)
+	return reaped
+}
+
+// decrementTokenCount decrements the validTokens entry for
+// a given token by 1. Should only be called when completing
+// a bundle. Once the last bundle completes, the keys mapped
+// to the token are forgotten. Completing a token with no
+// active bundle leaves its count at zero.
+func (c *SideInputCache) decrementTokenCount(tok token) {
+	count := c.validTokens[tok]
+	if count <= 0 {
+		if c.strict {
+			panic(fmt.Sprintf("statecache: bundle completed for token %q with no active bundle", string(tok)))
+		}
+		c.metrics.UnbalancedCompletions++
+		return
+	}
+	c.publishEvent(EventComplete, CacheKey{}, tok)
+	if count == 1 {
+		c.releaseToken(tok)
+	} else {
+		c.validTokens[tok] = count - 1
+	}
+}
+
+// releaseToken forgets the token along with the keys mapped to it.
+func (c *SideInputCache) releaseToken(tok token) {
+	delete(c.validTokens, tok)
+	delete(c.validSince, tok)
+	delete(c.bundleStats, tok)
+	for key := range c.tokenKeys[tok] {
+		delete(c.idsToTokens, key)
+	}
+	delete(c.tokenKeys, tok)
+}
+
+func (c *SideInputCache) makeAndValidateToken(key CacheKey) (token, bool) {
+	if key.UserStateID != "" {
+		return c.stateToken, c.stateToken != "" && c.isValid(c.stateToken)
+	}
+	// Tokens are validated for a multimap side input as a whole, covering all its lookup keys.
+	key.LookupKey = ""
+	// Check if it's a known token
+	tok, ok := c.idsToTokens[key]
+	if !ok {
+		return "", false
+	}
+	return tok, c.isValid(tok)
+}
+
+// CacheStatus describes the outcome of a query to the SideInputCache.
+type CacheStatus int
+
+const (
+	// Hit indicates the side input was found in the cache.
+	Hit CacheStatus = iota
+	// MissCold indicates the side input has a valid token but was never cached.
+	MissCold
+	// MissInvalidToken indicates the IDs do not map to a known, currently valid token.
+	MissInvalidToken
+	// MissEvicted indicates the side input was cached under its current token but
+	// has since been evicted or expired.
+	MissEvicted
+	// HitEmpty indicates the side input was found in the cache and is known to
+	// have no value.
+	HitEmpty
+	// MissInitFailed indicates the side input was found in the cache but failed
+	// to initialize, so it was removed.
+	MissInitFailed
+)
+
+func (s CacheStatus) String() string {
+	switch s {
+	case Hit:
+		return "Hit"
+	case MissCold:
+		return "MissCold"
+	case MissInvalidToken:
+		return "MissInvalidToken"
+	case MissEvicted:
+		return "MissEvicted"
+	case HitEmpty:
+		return "HitEmpty"
+	case MissInitFailed:
+		return "MissInitFailed"
+	default:
+		return fmt.Sprintf("CacheStatus(%d)", int(s))
+	}
+}
+
+// QueryCache takes a transform ID and side input ID and checking if a corresponding side
+// input has been cached. A query having a bad token (e.g. one that doesn't make a known
+// token or one that makes a known but currently invalid token) is treated the same as a
+// cache miss. An input cached under a token that has since been superseded by another token
+// for the same side input is removed, as it can never hit again. Since a hit updates the
+// recency of the entry, QueryCache takes the write lock.
+func (c *SideInputCache) QueryCache(transformID, sideInputID string) ReusableInput {
+	input, _ := c.QueryCacheWithStatus(transformID, sideInputID)
+	return input
+}
+
+// QueryByToken behaves like QueryCache for the side input covered by the cache token, for
+// callers holding the token as handed to the harness by the runner, returning whether the
+// input was found. A side input recorded as empty by SetCacheEmpty is found with a nil input.
+// The query misses if the token is not the one currently valid for the side input, and
+// always returns false for token types other than side input.
+func (c *SideInputCache) QueryByToken(ct fnpb.ProcessBundleRequest_CacheToken) (ReusableInput, bool) {
+	tok, key, ok := TokenFromProto(ct)
+	if !ok || key.SideInputID == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	key = c.sideInputKey(key.TransformID, key.SideInputID)
+	if mapped, ok := c.idsToTokens[key]; !ok || mapped != c.canonical(tok) {
+		return nil, false
+	}
+	input, status := c.query(key)
+	return input, status == Hit || status == HitEmpty
+}
+
+// QueryCacheContext behaves like QueryCache, except that on a miss while GetOrPopulate is
+// populating the same side input, the lookup waits for the populate and returns its result,
+// or returns early with the context's error if ctx is done first. Otherwise a miss is reported
+// as a nil ReusableInput with a nil error. A context already done when called returns its
+// error without querying the cache.
+func (c *SideInputCache) QueryCacheContext(ctx context.Context, transformID, sideInputID string) (ReusableInput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	key := c.sideInputKey(transformID, sideInputID)
+	input, status := c.query(key)
+	var call *populateCall
+	if status != Hit && status != HitEmpty {
+		call = c.populating[key]
+	}
+	c.unlock()
+	if call == nil {
+		return input, nil
+	}
+	select {
+	case <-call.done:
+		return call.input, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// QueryCacheWithStatus behaves like QueryCache, additionally returning a CacheStatus
+// describing why a query missed.
+func (c *SideInputCache) QueryCacheWithStatus(transformID, sideInputID string) (ReusableInput, CacheStatus) {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.query(c.sideInputKey(transformID, sideInputID))
+}
+
+// QueryCacheWithRetryAfter behaves like QueryCacheWithStatus, additionally returning how long
+// the caller should wait before refetching a side input that missed, so that callers do not
+// refetch in a tight loop while its token keeps being invalidated. The hint doubles with each
+// consecutive miss for the side input, up to a maximum, and resets on a hit. It is zero on a
+// hit, or if the backoff was not enabled with WithMissBackoff.
+func (c *SideInputCache) QueryCacheWithRetryAfter(transformID, sideInputID string) (ReusableInput, CacheStatus, time.Duration) {
+	c.mu.Lock()
+	defer c.unlock()
+	key := c.sideInputKey(transformID, sideInputID)
+	input, status := c.query(key)
+	return input, status, c.retryAfter(key)
+}
+
+// Contains reports whether a query for the transform ID and side input ID would currently hit,
+// such as to plan which side inputs to preload. Unlike QueryCache, it takes the read lock and
+// neither updates the recency of the entry nor counts a hit or miss.
+func (c *SideInputCache) Contains(transformID, sideInputID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key := c.sideInputKey(transformID, sideInputID)
+	tok, ok := c.makeAndValidateToken(key)
+	if !ok {
+		return false
+	}
+	entry, ok := c.cache[key]
+	return ok && entry.tok == tok && !entry.stale && !c.isExpired(entry)
+}
+
+// QueryCacheWithInit behaves like QueryCacheWithStatus, additionally calling Init on a hit
+// input so that a cached input which can no longer be initialized, such as one whose state
+// stream fails to reopen, is not handed out. On failure the entry is removed from the cache,
+// and nil is returned with the MissInitFailed status and the Init error; the query counts as
+// a miss in the metrics. Init is called without holding the cache's lock.
+//
+// Caches do not otherwise call Init, leaving it to the caller before each use of an input.
+func (c *SideInputCache) QueryCacheWithInit(transformID, sideInputID string) (ReusableInput, CacheStatus, error) {
+	key := c.sideInputKey(transformID, sideInputID)
+	c.mu.Lock()
+	input, status := c.query(key)
+	entry := c.cache[key]
+	tok, _ := c.makeAndValidateToken(key)
+	c.unlock()
+	if status != Hit {
+		return input, status, nil
+	}
+	if err := input.Init(); err != nil {
+		c.mu.Lock()
+		defer c.unlock()
+		if entry != nil && c.cache[key] == entry {
+			c.evict(entry)
+			c.metrics.InitFailures++
+		}
+		// The query was counted as a hit before the input failed to initialize.
+		c.metrics.Hits--
+		c.metrics.Misses++
+		if st, ok := c.bundleStats[tok]; ok {
+			st.Hits--
+			st.Misses++
+		}
+		return nil, MissInitFailed, errors.Wrapf(err, "failed to initialize side input %v of transform %v", sideInputID, transformID)
+	}
+	return input, Hit, nil
+}
+
+// QueryCacheStale behaves like QueryCache, except that if stale inputs are allowed with
+// WithAllowStale, an input that has expired or was invalidated is returned rather than nil,
+// with fresh set to false. The caller may use the stale input while refreshing it with
+// SetCache, which replaces it. Stale inputs are kept only until evicted, and are always
+// evictable. Fresh is false whenever the returned input is nil.
+func (c *SideInputCache) QueryCacheStale(transformID, sideInputID string) (in ReusableInput, fresh bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	key := c.sideInputKey(transformID, sideInputID)
+	input, status := c.query(key)
+	if status == Hit {
+		return input, true
+	}
+	if entry, ok := c.cache[key]; ok && entry.stale && !entry.empty {
+		in, err := c.read(entry.input)
+		if err != nil {
+			c.evict(entry)
+			c.metrics.DecodeFailures++
+			return nil, false
+		}
+		return in, false
+	}
+	return nil, false
+}
+
+// removeStale evicts an expired or invalidated entry, or keeps it marked as stale if stale
+// inputs are allowed, returning whether the entry was evicted.
+func (c *SideInputCache) removeStale(entry *cacheEntry) bool {
+	if c.allowStale {
+		entry.stale = true
+		return false
+	}
+	c.evict(entry)
+	return true
+}
+
+// retryAfter returns the retry hint for the key's current streak of misses.
+func (c *SideInputCache) retryAfter(key CacheKey) time.Duration {
+	n := c.missStreaks[key]
+	if n == 0 {
+		return 0
+	}
+	d := c.backoff
+	for i := 1; i < n && d < c.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.maxBackoff {
+		d = c.maxBackoff
+	}
+	return d
+}
+
+// query looks up the input cached for the key, tracking its streak of misses if backoff is
+// enabled. It should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) query(key CacheKey) (ReusableInput, CacheStatus) {
+	c.checkInitialized("QueryCache")
+	input, status := c.lookup(key)
+	if c.backoff > 0 {
+		if status == Hit || status == HitEmpty {
+			delete(c.missStreaks, key)
+		} else {
+			c.missStreaks[key]++
+		}
+	}
+	return input, status
+}
+
+// lookup looks up the input cached for the key. It should only be called by a goroutine
+// holding the write lock.
+func (c *SideInputCache) lookup(key CacheKey) (ReusableInput, CacheStatus) {
+	tok, ok := c.makeAndValidateToken(key)
+	if !ok {
+		c.logEvent("miss", key, tok)
+		return nil, MissInvalidToken
+	}
+	// Check to see if cached under the current token
+	entry, ok := c.cache[key]
+	if !ok || entry.tok != tok {
+		if ok && !entry.stale {
+			// The input was cached under a token since superseded, so it can never hit again.
+			// An entry kept as stale is counted once it is evicted for capacity instead.
+			if c.removeStale(entry) {
+				c.metrics.SupersededEvictions++
+			}
+		}
+		if input, ok := c.promote(key, tok); ok {
+			if input, err := c.read(input); err == nil {
+				c.logEvent("hit", key, tok)
+				c.metrics.Hits++
+				c.bundleStats[tok].Hits++
+				return input, Hit
+			}
+			if entry, ok := c.cache[key]; ok && entry.tok == tok {
+				c.evict(entry)
+			}
+			c.metrics.DecodeFailures++
+		}
+		c.logEvent("miss", key, tok)
+		c.metrics.Misses++
+		c.bundleStats[tok].Misses++
+		if c.evicted[key] == tok {
+			return nil, MissEvicted
+		}
+		return nil, MissCold
+	}
+	if entry.stale {
+		c.logEvent("miss", key, tok)
+		c.metrics.Misses++
+		c.bundleStats[tok].Misses++
+		return nil, MissEvicted
+	}
+	if c.isExpired(entry) {
+		// An entry kept as stale is counted once it is evicted for capacity instead.
+		if c.removeStale(entry) {
+			c.metrics.Expirations++
+		}
+		c.logEvent("miss", key, tok)
+		c.metrics.Misses++
+		c.bundleStats[tok].Misses++
+		return nil, MissEvicted
+	}
+
+	var input ReusableInput
+	if !entry.empty {
+		var err error
+		if input, err = c.read(entry.input); err != nil {
+			c.evict(entry)
+			c.logEvent("miss", key, tok)
+			c.metrics.DecodeFailures++
+			c.metrics.Misses++
+			c.bundleStats[tok].Misses++
+			return nil, MissEvicted
+		}
+	}
+
+	c.logEvent("hit", key, tok)
+	c.metrics.Hits++
+	c.bundleStats[tok].Hits++
+	c.policy.Touch(entry.key)
+	entry.accessed = c.now()
+	entry.hits++
+	if entry.empty {
+		return nil, HitEmpty
+	}
+	return input, Hit
+}
+
+// SetCache allows a user to place a ReusableInput materialized from the reader into the SideInputCache
+// with its corresponding transform ID and side input ID. If the IDs do not pair with a known, valid token
+// then we silently do not cache the input, as this is an indication that the runner is treating that input
+// as uncacheable. If the cache is full and every cached input is still in use, the input is
+// not cached. Use TrySetCache to learn whether the input was cached.
+func (c *SideInputCache) SetCache(transformID, sideInputID string, input ReusableInput) {
+	c.TrySetCache(transformID, sideInputID, input)
+}
+
+// TrySetCache behaves like SetCache, returning whether the input was actually cached. Callers
+// may use the result to decide whether to keep their own reference to an uncached input. An
+// input larger than the byte limit of the whole cache is rejected without evicting anything, as
+// is a nil input, which is counted by the NilRejections metric.
+func (c *SideInputCache) TrySetCache(transformID, sideInputID string, input ReusableInput) bool {
+	var ok bool
+	c.withEvictionLock(func() {
+		ok = c.trySet(c.sideInputKey(transformID, sideInputID), input, 1, false)
+	})
+	return ok
+}
+
+// SetCacheResult describes the outcome of a call to SetCacheEx.
+type SetCacheResult struct {
+	Cached  bool       // Whether the input was cached
+	Evicted []CacheKey // Keys evicted to make room, in the order they were evicted
+}
+
+// SetCacheEx behaves like TrySetCache, additionally returning the keys of the entries evicted
+// to make room for the input, for debugging side inputs that keep being refetched. Entries
+// spilled to the secondary cache count as evicted. The entry previously cached for the same
+// IDs is replaced rather than evicted, so it is not listed. Entries may be evicted even if the
+// input is not cached in the end.
+func (c *SideInputCache) SetCacheEx(transformID, sideInputID string, input ReusableInput) SetCacheResult {
+	var res SetCacheResult
+	c.withEvictionLock(func() {
+		c.displaced = &res.Evicted
+		res.Cached = c.trySet(c.sideInputKey(transformID, sideInputID), input, 1, false)
+		c.displaced = nil
+	})
+	return res
+}
+
+// SetCacheWeighted behaves like SetCache, except that the input takes weight units of the
+// capacity given to Init rather than one, so that large inputs can be accounted for coarsely
+// without a sizer. Enough evictable entries are evicted to free the weight of the new input.
+// An input weighing more than the whole capacity is rejected without evicting anything. The
+// weight is ignored by caches bounded by bytes, and a non-positive weight is treated as one.
+func (c *SideInputCache) SetCacheWeighted(transformID, sideInputID string, input ReusableInput, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	c.withEvictionLock(func() {
+		c.trySet(c.sideInputKey(transformID, sideInputID), input, weight, false)
+	})
+}
+
+// SetCacheEmpty records that the side input for the transform ID and side input ID is known to
+// have no value, so that QueryCacheWithStatus reports HitEmpty instead of a miss and callers can
+// skip refetching it. Empty entries count against capacity and obey token validity exactly like
+// cached inputs.
+func (c *SideInputCache) SetCacheEmpty(transformID, sideInputID string) {
+	c.withEvictionLock(func() {
+		c.trySet(c.sideInputKey(transformID, sideInputID), nil, 1, true)
+	})
+}
+
+// QueryUserState takes a transform ID and user state ID and returns the ReusableInput cached
+// for that user state under the current user state token, if any. As with QueryCache, nil is
+// returned on a miss, including when no user state token is valid.
+func (c *SideInputCache) QueryUserState(transformID, userStateID string) ReusableInput {
+	c.mu.Lock()
+	defer c.unlock()
+	input, _ := c.query(c.userStateKey(transformID, userStateID))
+	return input
+}
+
+// SetUserStateCache places a ReusableInput read from user state into the cache under the
+// current user state token. If no user state token is valid, the input is silently not cached,
+// as this indicates the runner is treating user state as uncacheable.
+func (c *SideInputCache) SetUserStateCache(transformID, userStateID string, input ReusableInput) {
+	c.withEvictionLock(func() {
+		c.trySet(c.userStateKey(transformID, userStateID), input, 1, false)
+	})
+}
+
+// QueryMultimapCache behaves like QueryCache for the values of one lookup key of a multimap
+// side input, cached by SetMultimapCache. The values of each lookup key are cached as an
+// entry of their own, so that a lookup does not require caching the whole multimap.
+func (c *SideInputCache) QueryMultimapCache(transformID, sideInputID, lookupKey string) ReusableInput {
+	c.mu.Lock()
+	defer c.unlock()
+	input, _ := c.query(c.multimapKey(transformID, sideInputID, lookupKey))
+	return input
+}
+
+// SetMultimapCache behaves like SetCache for the values of one lookup key of a multimap side
+// input. Tokens are validated for the side input as a whole, so the entries of all of its
+// lookup keys are in use, and are invalidated, together.
+func (c *SideInputCache) SetMultimapCache(transformID, sideInputID, lookupKey string, input ReusableInput) {
+	c.withEvictionLock(func() {
+		c.trySet(c.multimapKey(transformID, sideInputID, lookupKey), input, 1, false)
+	})
+}
+
+// trySet caches the input, or an empty entry, taking weight units of capacity for the key if
+// its token is valid and there is room. It should only be called by a goroutine holding the
+// write lock.
+func (c *SideInputCache) trySet(key CacheKey, input ReusableInput, weight int, empty bool) bool {
+	c.checkInitialized("SetCache")
+	if !c.initialized() || c.disabled {
+		return false
+	}
+	if input == nil && !empty {
+		// Use SetCacheEmpty to record a side input having no value.
+		c.metrics.NilRejections++
+		return false
+	}
+	tok, ok := c.makeAndValidateToken(key)
+	if !ok {
+		return false
+	}
+	if empty && c.negCap > 0 && c.byteLimit <= 0 {
+		return c.setNegative(key, tok)
+	}
+	var size int64
+	if !empty {
+		input = c.compress(input)
+		size = c.sizeOf(input)
+	}
+	if c.oversized(size) {
+		return false
+	}
+	if c.byteLimit <= 0 && weight > c.capacity {
+		c.metrics.OversizedRejections++
+		return false
+	}
+	// The room taken by the entry being replaced, if any, is counted as free, but the entry is
+	// only removed once its replacement is known to fit, so that it is kept otherwise.
+	n, need := weight, size
+	old, replacing := c.cache[key]
+	if replacing {
+		n -= old.weight
+		need -= old.size
+		c.replacing = map[CacheKey]bool{key: true}
+	}
+	evictions := c.metrics.CapacityEvictions
+	fits := c.makeRoom(n, need)
+	c.replacing = nil
+	if c.vetoDue {
+		return false
+	}
+	c.bundleStats[tok].Evictions += c.metrics.CapacityEvictions - evictions
+	if !fits && !c.overflows(n) {
+		// Nothing is deleted if every side input is still valid or vetoed, so record
+		// the failed eviction.
+		c.recordFailedEviction()
+		return false
+	}
+	if replacing {
+		c.replaceEntry(old, input)
+	}
+	c.insert(key, tok, input, size, weight).empty = empty
+	return true
+}
+
+// setNegative caches an empty entry for the key apart from the capacity, evicting empty entries
+// that are not in use if needed to stay within the bound set by WithFreeNegativeEntries. It
+// should only be called by a goroutine holding the write lock.
+func (c *SideInputCache) setNegative(key CacheKey, tok token) bool {
+	old, replacing := c.cache[key]
+	negative := func(k CacheKey) bool {
+		return c.cache[k].weight == 0 && c.evictable(k)
+	}
+	// Replacing an empty entry cached apart from the capacity needs no room of its own.
+	for !(replacing && old.weight == 0) && c.negatives >= c.negCap {
+		if c.awaitVeto() {
+			return false
+		}
+		victim, ok := c.policy.Victim(negative)
+		if !ok {
+			c.recordFailedEviction()
+			return false
+		}
+		c.evictForRoom(c.cache[victim])
+		c.metrics.CapacityEvictions++
+	}
+	if replacing {
+		c.replaceEntry(old, nil)
+	}
+	c.insert(key, tok, nil, 0, 0).empty = true
+	c.negatives++
+	return true
+}
+
+// Invalidate drops the cached input for the transform ID and side input ID and forgets the token
+// they map to, so that queries miss until a new token is validated for them via SetValidTokens.
+// Useful when an upstream recomputes a side input before the bundle using it completes. Other
+// IDs sharing the token are unaffected. The inputs cached for every lookup key of a multimap
+// side input are dropped too. Invalidating IDs with neither a token nor a cached input is a
+// no-op.
+func (c *SideInputCache) Invalidate(transformID, sideInputID string) {
+	c.mu.Lock()
+	defer c.unlock()
+	key := c.sideInputKey(transformID, sideInputID)
+	_, mapped := c.idsToTokens[key]
+	entries := c.multimapEntries(key)
+	if entry, ok := c.cache[key]; ok {
+		entries = append(entries, entry)
+	}
+	if !mapped && len(entries) == 0 {
+		return
+	}
+	c.unmapKey(key)
+	delete(c.spilled, key)
+	for k := range c.spilled {
+		if isLookupOf(k, key) {
+			delete(c.spilled, k)
+		}
+	}
+	for _, entry := range entries {
+		c.removeStale(entry)
+	}
+	c.metrics.ManualInvalidations++
+}
+
+// multimapEntries returns the entries cached for lookup keys of the side input. Lookup keys are
+// not indexed, as they are only gathered when invalidating a side input.
+func (c *SideInputCache) multimapEntries(key CacheKey) []*cacheEntry {
+	var entries []*cacheEntry
+	for k, entry := range c.cache {
+		if isLookupOf(k, key) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// isLookupOf reports whether k is the key of a lookup key of the side input key.
+func isLookupOf(k, key CacheKey) bool {
+	return k.LookupKey != "" && k.Namespace == key.Namespace && k.TransformID == key.TransformID && k.SideInputID == key.SideInputID
+}
+
+// CacheEntry pairs a ReusableInput with the transform ID and side input ID it
+// should be cached under.
+type CacheEntry struct {
+	TransformID string
+	SideInputID string
+	Input       ReusableInput
+}
+
+// SetCacheBatch places several ReusableInputs into the SideInputCache atomically. Entries are
+// treated the same as in SetCache, except that the room required by all of them is made in a
+// single eviction pass. If not every entry fits, entries are cached in order until the cache
+// is full.
+func (c *SideInputCache) SetCacheBatch(entries []CacheEntry) {
+	c.lockForEviction()
+	defer c.unlock()
+	c.checkInitialized("SetCacheBatch")
+	if !c.initialized() || c.disabled {
+		return
+	}
+	type pending struct {
+		CacheEntry
+		tok  token
+		size int64
+	}
+	var batch []pending
+	seen := make(map[CacheKey]int, len(entries))
+	var total int64
+	for _, e := range entries {
+		if e.Input == nil {
+			c.metrics.NilRejections++
+			continue
+		}
+		tok, ok := c.makeAndValidateToken(c.sideInputKey(e.TransformID, e.SideInputID))
+		if !ok {
+			continue
+		}
+		e.Input = c.compress(e.Input)
+		p := pending{CacheEntry: e, tok: tok, size: c.sizeOf(e.Input)}
+		if c.oversized(p.size) {
+			continue
+		}
+		key := c.sideInputKey(e.TransformID, e.SideInputID)
+		// A later entry for the same key replaces an earlier one.
+		if i, ok := seen[key]; ok {
+			total += p.size - batch[i].size
+			batch[i] = p
+			continue
+		}
+		seen[key] = len(batch)
+		batch = append(batch, p)
+		total += p.size
+	}
+	// As in trySet, the entries being replaced are counted as free room but only removed
+	// once their replacements are known to fit.
+	n := len(batch)
+	for key := range seen {
+		if old, ok := c.cache[key]; ok {
+			n -= old.weight
+			total -= old.size
+			if c.replacing == nil {
+				c.replacing = make(map[CacheKey]bool)
+			}
+			c.replacing[key] = true
+		}
+	}
+	c.makeRoom(n, total)
+	c.replacing = nil
+	for _, p := range batch {
+		key := c.sideInputKey(p.TransformID, p.SideInputID)
+		n, need := 1, p.size
+		old, replacing := c.cache[key]
+		if replacing {
+			n -= old.weight
+			need -= old.size
+		}
+		if !c.fits(n, need) && !c.overflows(n) {
+			c.recordFailedEviction()
+			continue
+		}
+		if replacing {
+			c.replaceEntry(old, p.Input)
+		}
+		c.insert(key, p.tok, p.Input, p.size, 1)
+	}
+}
+
+// oversized reports whether an entry of the given size could not fit even in an
+// empty cache, recording the rejection if so.
+func (c *SideInputCache) oversized(size int64) bool {
+	if c.byteLimit > 0 && size > c.byteLimit {
+		c.metrics.OversizedRejections++
+		return true
+	}
+	return false
+}
+
+// sizeOf returns the size of the input as reported by the configured sizer, or
+// zero if the cache is not bounded by size.
+func (c *SideInputCache) sizeOf(input ReusableInput) int64 {
+	if c.sizer == nil {
+		return 0
+	}
+	return c.sizer(input)
+}
+
+// insert adds and returns a new entry for the key cached under the token. The
+// caller must have already made room for it.
+func (c *SideInputCache) insert(key CacheKey, tok token, input ReusableInput, size int64, weight int) *cacheEntry {
+	delete(c.evicted, key)
+	entry := &cacheEntry{key: key, tok: tok, input: input, size: size, weight: weight, inserted: c.now()}
+	c.cache[key] = entry
+	c.logEvent("set", key, tok)
+	c.policy.Touch(key)
+	c.metrics.BytesInUse += size
+	if b, ok := input.(*bytesInput); ok && b.compressed {
+		c.metrics.UncompressedBytes += int64(b.rawLen)
+		c.metrics.CompressedBytes += int64(len(b.data))
+	}
+	c.used += weight
+	c.perTrans[key.TransformID]++
+	c.metrics.ConsecutiveInUseEvictions = 0
+	c.recordSet(false)
+	if n := int64(len(c.cache)); n > c.metrics.PeakEntries {
+		c.metrics.PeakEntries = n
+	}
+	if c.metrics.BytesInUse > c.metrics.PeakBytes {
+		c.metrics.PeakBytes = c.metrics.BytesInUse
+	}
+	c.signalEvictor()
+	return entry
+}
+
+// clock tells the current time, so that tests may control it.
+type clock interface {
+	Now() time.Time
+}
+
+// tickingClock is a clock that also provides tickers, returning the channel ticks are
+// delivered on along with a function stopping them.
+type tickingClock interface {
+	clock
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+// now returns the current time according to the cache's clock.
+func (c *SideInputCache) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// isExpired reports whether the entry has outlived the configured TTL.
+func (c *SideInputCache) isExpired(entry *cacheEntry) bool {
+	return c.ttl > 0 && c.now().Sub(entry.inserted) > c.ttl
+}
+
+// fits reports whether new entries taking n units of capacity and totalling the given size
+// can be added without exceeding the capacity of the cache.
+func (c *SideInputCache) fits(n int, size int64) bool {
+	if c.byteLimit > 0 {
+		return c.metrics.BytesInUse+size <= c.byteLimit
+	}
+	return c.used+n <= c.capacity
+}
+
+// overflows reports whether new entries taking n units of capacity fit within the overflow
+// buffer beyond the capacity of a cache bounded by entry count.
+func (c *SideInputCache) overflows(n int) bool {
+	return c.byteLimit <= 0 && c.used+n <= c.capacity+c.overflow
+}
+
+// removeEntry drops the entry from the cache, remembering its token so later misses
+// can be reported as MissEvicted.
+func (c *SideInputCache) removeEntry(entry *cacheEntry) {
+	delete(c.cache, entry.key)
+	c.policy.Remove(entry.key)
+	c.evicted[entry.key] = entry.tok
+	c.metrics.BytesInUse -= entry.size
+	c.used -= entry.weight
+	if entry.empty && entry.weight == 0 {
+		c.negatives--
+	}
+	c.perTrans[entry.key.TransformID]--
+}
+
+// replaceEntry removes the entry so that the input can be cached in its place, queueing the
+// entry's input for the eviction callback and closing like an evicted one, unless the same
+// input is being cached again.
+func (c *SideInputCache) replaceEntry(entry *cacheEntry, input ReusableInput) {
+	c.removeEntry(entry)
+	if !sameInput(entry.input, input) {
+		c.queueRemoved(entry)
+	}
+}
+
+// sameInput reports whether a and b are the same input, without panicking on inputs of
+// incomparable types, which are never the same.
+func sameInput(a, b ReusableInput) bool {
+	t := reflect.TypeOf(a)
+	return t != nil && t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// evict removes the entry from the cache and queues it for the eviction callback.
+func (c *SideInputCache) evict(entry *cacheEntry) {
+	c.removeEntry(entry)
+	c.metrics.LifetimeSamples++
+	c.metrics.TotalLifetime += c.now().Sub(entry.inserted)
+	c.logEvent("evict", entry.key, entry.tok)
+	c.queueRemoved(entry)
+}
+
+// queueRemoved queues a removed entry for the eviction callback, if one is configured and
+// the entry holds a side input, and for closing, if its input implements io.Closer.
+func (c *SideInputCache) queueRemoved(entry *cacheEntry) {
+	if entry.empty {
+		return
+	}
+	_, closer := entry.input.(io.Closer)
+	if closer || (c.onEvict != nil && entry.key.UserStateID == "") {
+		c.removed = append(c.removed, entry)
+	}
+}
+
+// SetEventLog sets a writer to which a one line record is written for every hit, miss, set,
+// eviction, and token validation, for the purposes of debugging cache behavior. Each record
+// holds the timestamp, the operation, the transform ID, the side input ID, and the token.
+// A failure to close an evicted input is recorded as a "close" record followed by the error.
+// Records are written while the cache's lock is held, so w should not block. Passing nil
+// disables the log.
+func (c *SideInputCache) SetEventLog(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.eventLog = w
+}
+
+// logEvent writes a record of the operation to the event log, if one is set, and publishes it
+// to subscribers.
+func (c *SideInputCache) logEvent(op string, key CacheKey, tok token) {
+	c.publish(op, key, tok)
+	if c.eventLog == nil {
+		return
+	}
+	fmt.Fprintf(c.eventLog, "%v %v %q %q %q\n", c.now().UTC().Format(time.RFC3339Nano), op, key.TransformID, key.SideInputID, string(tok))
+}
+
+// logCloseError writes a record of a failure to close the entry's input to the event log,
+// if one is set. It acquires the write lock, so must be called without it held.
+func (c *SideInputCache) logCloseError(entry *cacheEntry, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.eventLog == nil {
+		return
+	}
+	fmt.Fprintf(c.eventLog, "%v close %q %q %q %q\n", c.now().UTC().Format(time.RFC3339Nano), entry.key.TransformID, entry.key.SideInputID, string(entry.tok), err)
+}
+
+// recordFailedEviction records a failure to make room for an input, as a vetoed eviction if
+// the veto set by WithEvictionVeto kept an otherwise evictable entry, and as an in-use
+// eviction otherwise.
+func (c *SideInputCache) recordFailedEviction() {
+	if c.anyVetoed() {
+		c.metrics.VetoedEvictions++
+		return
+	}
+	c.recordInUseEviction()
+}
+
+// recordInUseEviction records a failure to make room because every cached input is in use,
+// queueing the starvation alert once the configured number of consecutive failures is reached.
+func (c *SideInputCache) recordInUseEviction() {
+	c.metrics.InUseEvictions++
+	c.metrics.ConsecutiveInUseEvictions++
+	if c.onStarve != nil && c.metrics.ConsecutiveInUseEvictions == int64(c.starveAt) {
+		c.starved = true
+	}
+	c.recordSet(true)
+}
+
+// recordSet records whether an attempt to cache an input failed as an in-use eviction in the
+// window of WithUnderSizedCallback, if set, marking the callback due once the ratio of in-use
+// evictions in the window reaches its threshold.
+func (c *SideInputCache) recordSet(inUse bool) {
+	if c.undersize != nil && c.undersize.record(inUse) {
+		c.underDue = true
+	}
+}
+
+// setWindow tracks the outcomes of the latest attempts to cache an input.
+type setWindow struct {
+	inUse     []bool // Ring buffer of outcomes, true for in-use evictions
+	next      int    // Index of the oldest outcome, overwritten next
+	full      bool
+	count     int // In-use evictions in the window
+	threshold float64
+	crossed   bool // Whether the ratio is at or above the threshold
+}
+
+// record adds an outcome to the window, returning true if this makes the ratio of in-use
+// evictions reach the threshold. Once reached, it must drop below the threshold before
+// true is returned again. No ratio is computed until the window is full.
+func (w *setWindow) record(inUse bool) bool {
+	if w.inUse[w.next] {
+		w.count--
+	}
+	w.inUse[w.next] = inUse
+	if inUse {
+		w.count++
+	}
+	w.next++
+	if w.next == len(w.inUse) {
+		w.next = 0
+		w.full = true
+	}
+	if !w.full {
+		return false
+	}
+	above := w.ratio() >= w.threshold
+	crossed := above && !w.crossed
+	w.crossed = above
+	return crossed
+}
+
+// ratio returns the fraction of the outcomes in the window that are in-use evictions.
+func (w *setWindow) ratio() float64 {
+	return float64(w.count) / float64(len(w.inUse))
+}
+
+// unlock releases the write lock, then puts any entries spilled while it was held into the
+// secondary cache, and invokes the eviction callback for, and closes, any entries evicted
+// while it was held so that none of these blocks other users of the cache. Changes to the
+// metrics are then pushed to the registry set by RegisterMetrics. The starvation and
+// undersize alerts, if due, are invoked last.
+func (c *SideInputCache) unlock() {
+	c.allowed = nil
+	c.deferVeto, c.vetoDue = false, false
+	removed := c.removed
+	c.removed = nil
+	spills := c.spills
+	c.spills = nil
+	secondary := c.secondary
+	export := c.collectExport()
+	onEvict := c.onEvict
+	var onStarve func()
+	if c.starved {
+		onStarve = c.onStarve
+		c.starved = false
+	}
+	var onUnder func(float64)
+	var ratio float64
+	if c.underDue {
+		onUnder, ratio = c.onUnder, c.undersize.ratio()
+		c.underDue = false
+	}
+	c.mu.Unlock()
+	defer func() {
+		if onStarve != nil {
+			onStarve()
+		}
+		if onUnder != nil {
+			onUnder(ratio)
+		}
+	}()
+	for _, entry := range spills {
+		secondary.Put(entry.key, entry.input)
+	}
+	for _, entry := range removed {
+		if onEvict != nil && entry.key.UserStateID == "" {
+			onEvict(entry.key.TransformID, entry.key.SideInputID, entry.input)
+		}
+		if closer, ok := entry.input.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				c.logCloseError(entry, err)
+			}
+		}
+	}
+	export.push()
+}
+
+// IsValidToken reports whether the token is currently valid, meaning it belongs to an
+// in-flight bundle: it was set by SetValidTokens and not yet completed by CompleteBundle.
+// Only inputs cached under a valid token can be set or returned by queries.
+func (c *SideInputCache) IsValidToken(tok []byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.isValid(c.canonical(token(tok)))
+}
+
+func (c *SideInputCache) isValid(tok token) bool {
+	count, ok := c.validTokens[tok]
+	// If the token is not known or not in use, return false
+	return ok && count > 0
+}
+
+// makeRoom evicts ReusableInputs that are not currently valid from the cache, in the order chosen
+// by the eviction policy, until n new entries totalling the given size fit. Entries of transforms
+// that are over their quota are evicted first. Once eviction is needed, at least the configured
+// eviction batch of entries is evicted, if that many are evictable. Returns false if every
+// remaining cached input is still in use and the entries still do not fit. It should only be
+// called by a goroutine holding the write lock.
+func (c *SideInputCache) makeRoom(n int, size int64) bool {
+	if c.fits(n, size) {
+		return true
+	}
+	start := c.metrics.CapacityEvictions
+	c.evictUntil(func() bool {
+		return c.fits(n, size) && c.metrics.CapacityEvictions-start >= int64(c.evictBatch)
+	})
+	return c.fits(n, size)
+}
+
+// evictUntil evicts ReusableInputs as makeRoom does until done returns true, returning false if
+// no evictable input remains first. It should only be called by a goroutine holding the write
+// lock.
+func (c *SideInputCache) evictUntil(done func() bool) bool {
+	if !done() && c.awaitVeto() {
+		return false
+	}
+	if len(c.quotas) > 0 {
+		overQuota := func(key CacheKey) bool {
+			return c.evictable(key) && c.overQuota(key.TransformID)
+		}
+		for !done() {
+			key, ok := c.policy.Victim(overQuota)
+			if !ok {
+				break
+			}
+			c.evictForRoom(c.cache[key])
+			c.metrics.CapacityEvictions++
+			c.metrics.QuotaEvictions++
+		}
+	}
+	for !done() {
+		key, ok := c.policy.Victim(c.evictable)
+		if !ok {
+			return false
+		}
+		c.evictForRoom(c.cache[key])
+		c.metrics.CapacityEvictions++
+	}
+	return true
+}
+
+// canonical returns the known token equivalent to tok under the comparator set by
+// WithTokenComparator, so that equivalent tokens share a single entry in every map keyed
+// by token. Valid tokens are preferred, then those of cached entries. Returns tok itself if
+// no comparator is set or no equivalent token is known. It should only be called by a
+// goroutine holding the lock.
+func (c *SideInputCache) canonical(tok token) token {
+	if c.sameToken == nil {
+		return tok
+	}
+	if _, ok := c.validTokens[tok]; ok {
+		return tok
+	}
+	for known := range c.validTokens {
+		if c.sameToken([]byte(known), []byte(tok)) {
+			return known
+		}
+	}
+	for _, entry := range c.cache {
+		if c.sameToken([]byte(entry.tok), []byte(tok)) {
+			return entry.tok
+		}
+	}
+	return tok
+}
+
+// evictable reports whether the cached entry for the key may be evicted. An element is not
+// evicted if it's currently valid or pinned, unless it is stale, nor while room is being made
+// for its replacement.
+func (c *SideInputCache) evictable(key CacheKey) bool {
+	return c.releasable(key) && !c.vetoed(key) && !c.replacing[key]
+}
+
+// releasable reports whether the entry for the key is neither in use nor pinned, regardless
+// of the veto set by WithEvictionVeto.
+func (c *SideInputCache) releasable(key CacheKey) bool {
+	entry := c.cache[key]
+	return (entry.stale || !c.isValid(entry.tok)) && !c.pinned[key]
 }
@@ -16,7 +16,16 @@
 package statecache
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	fnpb "github.com/apache/beam/sdks/v2/go/pkg/beam/model/fnexecution_v1"
 )
@@ -57,11 +66,301 @@ func TestInit(t *testing.T) {
 	}
 }
 
+func TestSetValidTokens_SingleThenMany(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(DefaultCacheSize)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	single := makeRequest("t1", "s1", "tok1")
+	for i := 0; i < 3; i++ {
+		s.SetValidTokens(single)
+		s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", i))
+		s.CompleteBundle(single)
+	}
+	// A bundle with one side input overlaps one with many.
+	s.SetValidTokens(single)
+	many := makeBenchmarkTokens(DefaultCacheSize - 1)
+	s.SetValidTokens(many...)
+	for _, tok := range many {
+		side := tok.GetSideInput()
+		s.SetCache(side.GetTransformId(), side.GetSideInputId(), makeTestReusableInput(side.GetTransformId(), side.GetSideInputId(), 1))
+	}
+	if got := s.QueryCache("t1", "s1"); got == nil || got.Value() != 2 {
+		t.Errorf("single side input incorrect after many tokens validated, expected 2, got %v", got)
+	}
+	if len(s.validTokens) != DefaultCacheSize || len(s.cache) != DefaultCacheSize {
+		t.Errorf("tokens or entries lost, expected %v of each, got %v and %v", DefaultCacheSize, len(s.validTokens), len(s.cache))
+	}
+	s.CompleteBundle(many...)
+	s.CompleteBundle(single)
+	if len(s.validTokens) != 0 || len(s.idsToTokens) != 0 {
+		t.Errorf("tokens remaining after every bundle completed, got %v", s.validTokens)
+	}
+}
+
+func TestSetValidTokensMode(t *testing.T) {
+	tests := []struct {
+		mode      TokenMode
+		count     int  // Active bundles after validating the token twice.
+		completed bool // Whether the token is complete after one CompleteBundle.
+	}{
+		{mode: IncrementMode, count: 2, completed: false},
+		{mode: IdempotentMode, count: 1, completed: true},
+	}
+	for _, test := range tests {
+		var s SideInputCache
+		err := s.Init(1)
+		if err != nil {
+			t.Fatalf("cache init failed, got %v", err)
+		}
+		s.SetValidTokensMode(test.mode)
+		tok := makeRequest("t1", "s1", "tok1")
+		s.SetValidTokens(tok)
+		s.SetValidTokens(tok, tok)
+		if counts := s.TokenRefCounts(); len(counts) != 1 || counts[0].Count != test.count {
+			t.Errorf("mode %v token refcounts incorrect, expected count %v, got %v", test.mode, test.count, counts)
+		}
+		s.CompleteBundle(tok)
+		if got := !s.IsValidToken([]byte("tok1")); got != test.completed {
+			t.Errorf("mode %v token completed after one CompleteBundle incorrect, expected %v, got %v", test.mode, test.completed, got)
+		}
+	}
+}
+
+func TestTokenRefcount_Peak(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	for i := 0; i < 3; i++ {
+		s.SetValidTokens(tok)
+	}
+	s.CompleteBundle(tok)
+	s.CompleteBundle(tok)
+	s.SetValidTokens(tok)
+
+	counts := s.TokenRefCounts()
+	if len(counts) != 1 || counts[0].Count != 2 || counts[0].Peak != 3 {
+		t.Fatalf("token refcounts incorrect, expected count 2 and peak 3, got %v", counts)
+	}
+	if st := s.BundleStats([]byte("tok1")); st.PeakBundles != 3 {
+		t.Errorf("peak bundles incorrect, expected 3, got %v", st.PeakBundles)
+	}
+}
+
+func TestWithMaxTokenRefcount(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2, WithMaxTokenRefcount(2))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	for i := 0; i < 2; i++ {
+		if n, err := s.TrySetValidTokens(tokOne); n != 1 || err != nil {
+			t.Fatalf("TrySetValidTokens within limit incorrect, expected 1 and nil, got %v and %v", n, err)
+		}
+	}
+
+	// The over-limit token rejects the whole call, so tok2 is not validated either.
+	n, err := s.TrySetValidTokens(tokTwo, tokOne)
+	if n != 0 || !errors.Is(err, ErrTooManyBundles) {
+		t.Errorf("TrySetValidTokens over limit incorrect, expected 0 and %v, got %v and %v", ErrTooManyBundles, n, err)
+	}
+	if n := s.SetValidTokens(tokOne); n != 0 {
+		t.Errorf("SetValidTokens over limit incorrect, expected 0 tokens applied, got %v", n)
+	}
+	if s.IsValidToken([]byte("tok2")) {
+		t.Errorf("token of rejected call validated")
+	}
+	if counts := s.TokenRefCounts(); len(counts) != 1 || counts[0].Count != 2 {
+		t.Errorf("token refcounts incorrect after rejected calls, expected tok1 with count 2, got %v", counts)
+	}
+
+	s.CompleteBundle(tokOne)
+	if _, err := s.TrySetValidTokens(tokOne, tokTwo); err != nil {
+		t.Errorf("TrySetValidTokens failed after a bundle completed, got %v", err)
+	}
+}
+
+func TestWithMaxTokenRefcount_AboveInt8(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithMaxTokenRefcount(200))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	for i := 0; i < 200; i++ {
+		if _, err := s.TrySetValidTokens(tok); err != nil {
+			t.Fatalf("TrySetValidTokens within limit failed on bundle %v, got %v", i+1, err)
+		}
+	}
+	if count := s.validTokens["tok1"]; count != 200 {
+		t.Errorf("token count incorrect, expected 200, got %v", count)
+	}
+	if !s.IsValidToken(tok.GetToken()) {
+		t.Errorf("token invalid with 200 active bundles")
+	}
+	if _, err := s.TrySetValidTokens(tok); !errors.Is(err, ErrTooManyBundles) {
+		t.Errorf("TrySetValidTokens over limit incorrect, expected %v, got %v", ErrTooManyBundles, err)
+	}
+	if !s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10)) {
+		t.Errorf("input not cached for token with 200 active bundles")
+	}
+	if st := s.BundleStats(tok.GetToken()); st.PeakBundles != 200 {
+		t.Errorf("peak bundles incorrect, expected 200, got %v", st.PeakBundles)
+	}
+
+	data, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed, got %v", err)
+	}
+	var r SideInputCache
+	if err := r.Init(1); err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if err := r.Restore(data); err != nil {
+		t.Fatalf("Restore failed, got %v", err)
+	}
+	if count := r.validTokens["tok1"]; count != 200 {
+		t.Errorf("restored token count incorrect, expected 200, got %v", count)
+	}
+}
+
+func TestSizeFromResourceHints(t *testing.T) {
+	tests := []struct {
+		name   string
+		hints  map[string]string
+		want   int
+		wantOk bool
+	}{
+		{name: "valid", hints: map[string]string{SizeHintURN: "50"}, want: 50, wantOk: true},
+		{name: "nil", hints: nil, want: DefaultCacheSize},
+		{name: "missing", hints: map[string]string{"beam:resources:min_ram_bytes:v1": "1000"}, want: DefaultCacheSize},
+		{name: "malformed", hints: map[string]string{SizeHintURN: "fifty"}, want: DefaultCacheSize},
+		{name: "zero", hints: map[string]string{SizeHintURN: "0"}, want: DefaultCacheSize},
+		{name: "negative", hints: map[string]string{SizeHintURN: "-5"}, want: DefaultCacheSize},
+	}
+	for _, test := range tests {
+		got, ok := SizeFromResourceHints(test.hints)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("SizeFromResourceHints(%v) incorrect, expected %v, %v, got %v, %v", test.name, test.want, test.wantOk, got, ok)
+		}
+	}
+}
+
+// sizedInput is a ReusableInput estimating its own size.
+type sizedInput struct {
+	TestReusableInput
+	size int64
+}
+
+func (s *sizedInput) EstimatedBytes() int64 {
+	return s.size
+}
+
+func TestEstimatedBytes(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(4)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if got := s.EstimatedBytes(); got != 0 {
+		t.Errorf("estimate of empty cache incorrect, expected 0, got %v", got)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t2", "s2", "tok2"), makeRequest("t3", "s3", "tok3"), makeRequest("t4", "s4", "tok4"))
+	s.SetCache("t1", "s1", &sizedInput{TestReusableInput: TestReusableInput{transformID: "t1", sideInputID: "s1", value: 1}, size: 100})
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 2))
+	s.SetCache("t3", "s3", NewBytesInput(make([]byte, 50)))
+	s.SetCacheEmpty("t4", "s4")
+
+	// The unsized input and the empty entry are not counted.
+	if got := s.EstimatedBytes(); got != 150 {
+		t.Errorf("estimated bytes incorrect, expected 150, got %v", got)
+	}
+}
+
+func TestInitDisabled(t *testing.T) {
+	var s SideInputCache
+	err := s.InitDisabled()
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	if s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10)) {
+		t.Errorf("TrySetCache cached input in disabled cache")
+	}
+	s.SetCacheEmpty("t1", "s1")
+	s.SetCacheBatch([]CacheEntry{{TransformID: "t1", SideInputID: "s1", Input: makeTestReusableInput("t1", "s1", 10)}})
+	if len(s.cache) != 0 {
+		t.Errorf("disabled cache holds entries, got %v", len(s.cache))
+	}
+	for i := 0; i < 2; i++ {
+		if in, status := s.QueryCacheWithStatus("t1", "s1"); in != nil || status != MissCold {
+			t.Errorf("query of disabled cache incorrect, expected nil and %v, got %v and %v", MissCold, in, status)
+		}
+	}
+	m := s.Metrics()
+	if m.Misses != 2 {
+		t.Errorf("number of misses incorrect, expected 2, got %v", m.Misses)
+	}
+	if m.InUseEvictions != 0 || m.CapacityShortfall != 0 {
+		t.Errorf("disabled cache counted as full, got %v in use evictions and %v capacity shortfall", m.InUseEvictions, m.CapacityShortfall)
+	}
+	if err := s.Resize(2); err == nil {
+		t.Errorf("Resize of disabled cache succeeded but should have failed")
+	}
+
+	// Reinit enables caching.
+	if err := s.Reinit(1); err != nil {
+		t.Fatalf("Reinit failed, got %v", err)
+	}
+	s.SetValidTokens(tok)
+	if !s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10)) {
+		t.Errorf("TrySetCache did not cache input after Reinit")
+	}
+}
+
+func TestInitDefault(t *testing.T) {
+	var s SideInputCache
+	err := s.InitDefault()
+	if err != nil {
+		t.Fatalf("SideInputCache failed but should have succeeded, got %v", err)
+	}
+	if s.capacity != DefaultCacheSize {
+		t.Errorf("capacity incorrect, expected %v, got %v", DefaultCacheSize, s.capacity)
+	}
+}
+
+func TestInit_Negative(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(-5)
+	if !errors.Is(err, ErrInvalidCapacity) {
+		t.Fatalf("SideInputCache init error incorrect, expected ErrInvalidCapacity, got %v", err)
+	}
+	if want := "capacity must be a positive integer, got -5"; err.Error() != want {
+		t.Errorf("SideInputCache init error message incorrect, expected %q, got %q", want, err.Error())
+	}
+	if s.cache != nil {
+		t.Errorf("failed init made the cache, got %v", s.cache)
+	}
+}
+
 func TestInit_Bad(t *testing.T) {
 	var s SideInputCache
 	err := s.Init(0)
 	if err == nil {
-		t.Error("SideInputCache init succeeded but should have failed")
+		t.Fatal("SideInputCache init succeeded but should have failed")
+	}
+	if !errors.Is(err, ErrInvalidCapacity) {
+		t.Errorf("SideInputCache init error incorrect, expected ErrInvalidCapacity, got %v", err)
+	}
+	if want := "capacity must be a positive integer, got 0"; err.Error() != want {
+		t.Errorf("SideInputCache init error message incorrect, expected %q, got %q", want, err.Error())
 	}
 }
 
@@ -128,6 +427,178 @@ func makeRequest(transformID, sideInputID string, t token) fnpb.ProcessBundleReq
 	return tok
 }
 
+func TestTokenFromProto(t *testing.T) {
+	var untyped fnpb.ProcessBundleRequest_CacheToken
+	untyped.Token = []byte("tok3")
+	tests := []struct {
+		name    string
+		ct      fnpb.ProcessBundleRequest_CacheToken
+		wantTok token
+		wantKey CacheKey
+		wantOk  bool
+	}{
+		{
+			name:    "side input",
+			ct:      makeRequest("t1", "s1", "tok1"),
+			wantTok: "tok1",
+			wantKey: CacheKey{TransformID: "t1", SideInputID: "s1"},
+			wantOk:  true,
+		},
+		{
+			name:    "user state",
+			ct:      makeUserStateRequest("tok2"),
+			wantTok: "tok2",
+			wantKey: CacheKey{},
+			wantOk:  true,
+		},
+		{
+			name:   "untyped",
+			ct:     untyped,
+			wantOk: false,
+		},
+	}
+	for _, test := range tests {
+		tok, key, ok := TokenFromProto(test.ct)
+		if tok != test.wantTok || key != test.wantKey || ok != test.wantOk {
+			t.Errorf("TokenFromProto(%v) incorrect, expected %v, %v, %v, got %v, %v, %v", test.name, test.wantTok, test.wantKey, test.wantOk, tok, key, ok)
+		}
+	}
+}
+
+// expectPanic fails the test unless f panics with a message containing want.
+func expectPanic(t *testing.T, want string, f func()) {
+	t.Helper()
+	defer func() {
+		t.Helper()
+		r := recover()
+		if r == nil {
+			t.Errorf("expected a panic containing %q, got none", want)
+			return
+		}
+		if msg := fmt.Sprint(r); !strings.Contains(msg, want) {
+			t.Errorf("panic incorrect, expected it to contain %q, got %v", want, msg)
+		}
+	}()
+	f()
+}
+
+func TestWithStrictMode(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithStrictMode())
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	expectPanic(t, "initialized twice", func() { s.Init(1) })
+	expectPanic(t, "initialized twice", func() { s.InitWithByteLimit(10, func(ReusableInput) int64 { return 1 }) })
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.CompleteBundle(tok)
+	expectPanic(t, `token "tok1" with no active bundle`, func() { s.CompleteBundle(tok) })
+
+	// The cache remains usable after a panic.
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("call to query cache missed when should have hit")
+	}
+}
+
+func TestSetStrictMode_BeforeInit(t *testing.T) {
+	var s SideInputCache
+	s.SetStrictMode(true)
+	in := makeTestReusableInput("t1", "s1", 10)
+	expectPanic(t, "SetCache called before Init", func() { s.SetCache("t1", "s1", in) })
+	expectPanic(t, "SetCache called before Init", func() { s.TrySetCache("t1", "s1", in) })
+	expectPanic(t, "SetCacheBatch called before Init", func() {
+		s.SetCacheBatch([]CacheEntry{{TransformID: "t1", SideInputID: "s1", Input: in}})
+	})
+	expectPanic(t, "QueryCache called before Init", func() { s.QueryCache("t1", "s1") })
+
+	// The lock is released by the panics, and the cache stays strict once initialized.
+	if err := s.Init(1); err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	expectPanic(t, "initialized twice", func() { s.Init(1) })
+
+	var lenient SideInputCache
+	lenient.SetStrictMode(true)
+	lenient.SetStrictMode(false)
+	lenient.SetCache("t1", "s1", in)
+	if output := lenient.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("QueryCache hit in an uninitialized cache, got %v", output)
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	var s SideInputCache
+	tok := makeRequest("t1", "s1", "tok1")
+	in := makeTestReusableInput("t1", "s1", 10)
+
+	if n := s.SetValidTokens(tok); n != 0 {
+		t.Errorf("SetValidTokens applied tokens to an uninitialized cache, got %v", n)
+	}
+	if s.TrySetCache("t1", "s1", in) {
+		t.Errorf("TrySetCache cached an input in an uninitialized cache")
+	}
+	s.SetCache("t1", "s1", in)
+	s.SetCacheWeighted("t1", "s1", in, 1)
+	s.SetCacheEmpty("t1", "s1")
+	s.SetCacheBatch([]CacheEntry{{TransformID: "t1", SideInputID: "s1", Input: in}})
+	s.SetUserStateCache("t1", "u1", in)
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("QueryCache hit in an uninitialized cache, got %v", output)
+	}
+	if _, status := s.QueryCacheWithStatus("t1", "s1"); status != MissInvalidToken {
+		t.Errorf("QueryCacheWithStatus incorrect, expected MissInvalidToken, got %v", status)
+	}
+	if output := s.QueryUserState("t1", "u1"); output != nil {
+		t.Errorf("QueryUserState hit in an uninitialized cache, got %v", output)
+	}
+	if s.Contains("t1", "s1") {
+		t.Errorf("Contains reported an input in an uninitialized cache")
+	}
+	s.CompleteBundle(tok)
+	s.CompleteBundles(tok)
+	s.Invalidate("t1", "s1")
+	s.Pin("t1", "s1")
+	s.Unpin("t1", "s1")
+	s.SetTransformQuota("t1", 1)
+	if n := s.EvictFraction(1); n != 0 {
+		t.Errorf("EvictFraction evicted entries of an uninitialized cache, got %v", n)
+	}
+	if s.Len() != 0 || s.Cap() != 0 || s.Utilization() != 0 || len(s.Keys()) != 0 {
+		t.Errorf("uninitialized cache reported entries or capacity")
+	}
+	if m := s.Metrics(); m != (CacheMetrics{}) {
+		t.Errorf("uninitialized cache reported metrics, got %+v", m)
+	}
+	if err := s.Resize(2); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("Resize error incorrect, expected ErrNotInitialized, got %v", err)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed, got %v", err)
+	}
+	if err := s.Restore(snap); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("Restore error incorrect, expected ErrNotInitialized, got %v", err)
+	}
+	if _, err := s.DumpJSON(); err != nil {
+		t.Errorf("DumpJSON failed, got %v", err)
+	}
+	s.Clear()
+
+	// The cache works as usual once initialized.
+	if err := s.Init(1); err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", in)
+	if output := s.QueryCache("t1", "s1"); output != in {
+		t.Errorf("QueryCache after Init incorrect, expected %v, got %v", in, output)
+	}
+}
+
 func TestSetValidTokens(t *testing.T) {
 	inputs := []struct {
 		transformID string
@@ -174,7 +645,7 @@ func TestSetValidTokens(t *testing.T) {
 			t.Errorf("error in input %v, token %v is not valid", i, input.tok)
 		}
 		// Check that the mapping of IDs to tokens is correct
-		mapped := s.idsToTokens[input.transformID+input.sideInputID]
+		mapped := s.idsToTokens[CacheKey{TransformID: input.transformID, SideInputID: input.sideInputID}]
 		if mapped != input.tok {
 			t.Errorf("token mismatch for input %v, expected %v, got %v", i, input.tok, mapped)
 		}
@@ -220,7 +691,7 @@ func TestSetValidTokens_ClearingBetween(t *testing.T) {
 			t.Errorf("error in input %v, token %v is not valid", i, input.tk)
 		}
 		// Check that the mapping of IDs to tokens is correct
-		mapped := s.idsToTokens[input.transformID+input.sideInputID]
+		mapped := s.idsToTokens[CacheKey{TransformID: input.transformID, SideInputID: input.sideInputID}]
 		if mapped != input.tk {
 			t.Errorf("token mismatch for input %v, expected %v, got %v", i, input.tk, mapped)
 		}
@@ -235,6 +706,24 @@ func TestSetValidTokens_ClearingBetween(t *testing.T) {
 	}
 }
 
+func TestSetValidTokens_CapacityShortfall(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	// Side inputs sharing a token still need an entry each.
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t1", "s2", "tok1"))
+	if s.metrics.CapacityShortfall != 0 {
+		t.Errorf("capacity shortfall counted for a bundle within capacity, got %v", s.metrics.CapacityShortfall)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t1", "s2", "tok1"), makeRequest("t2", "s3", "tok2"), makeUserStateRequest("tok3"))
+	if s.metrics.CapacityShortfall != 1 {
+		t.Errorf("number of capacity shortfalls incorrect, expected 1, got %v", s.metrics.CapacityShortfall)
+	}
+}
+
 func TestSetCache_Eviction(t *testing.T) {
 	var s SideInputCache
 	err := s.Init(1)
@@ -257,8 +746,75 @@ func TestSetCache_Eviction(t *testing.T) {
 	if len(s.cache) != 1 {
 		t.Errorf("cache size incorrect, expected 1, got %v", len(s.cache))
 	}
-	if s.metrics.Evictions != 1 {
-		t.Errorf("number evictions incorrect, expected 1, got %v", s.metrics.Evictions)
+	if s.metrics.CapacityEvictions != 1 {
+		t.Errorf("number evictions incorrect, expected 1, got %v", s.metrics.CapacityEvictions)
+	}
+}
+
+func TestWithEvictionBatch(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(4, WithEvictionBatch(3))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	var toks []fnpb.ProcessBundleRequest_CacheToken
+	for i := 1; i <= 4; i++ {
+		transID, sideID := fmt.Sprintf("t%d", i), fmt.Sprintf("s%d", i)
+		tok := makeRequest(transID, sideID, token(fmt.Sprintf("tok%d", i)))
+		toks = append(toks, tok)
+		s.SetValidTokens(tok)
+		s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, i))
+	}
+	// Leave the second entry in use, so only three are evictable.
+	s.CompleteBundle(toks[0], toks[2], toks[3])
+
+	tokFive := makeRequest("t5", "s5", "tok5")
+	s.SetValidTokens(tokFive)
+	s.SetCache("t5", "s5", makeTestReusableInput("t5", "s5", 5))
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect, expected 2, got %v", len(s.cache))
+	}
+	if s.metrics.CapacityEvictions != 3 {
+		t.Errorf("number evictions incorrect, expected 3, got %v", s.metrics.CapacityEvictions)
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t2", SideInputID: "s2"}]; !ok {
+		t.Errorf("in use entry was evicted by a batch")
+	}
+
+	// With fewer evictable entries than the batch, only those are evicted.
+	s.CompleteBundle(toks[1], tokFive)
+	for i := 6; i <= 8; i++ {
+		transID, sideID := fmt.Sprintf("t%d", i), fmt.Sprintf("s%d", i)
+		s.SetValidTokens(makeRequest(transID, sideID, token(fmt.Sprintf("tok%d", i))))
+		s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, i))
+	}
+	s.SetValidTokens(makeRequest("t9", "s9", "tok9"))
+	if !s.TrySetCache("t9", "s9", makeTestReusableInput("t9", "s9", 9)) {
+		t.Errorf("TrySetCache failed with evictable entries cached")
+	}
+	if s.metrics.CapacityEvictions != 5 {
+		t.Errorf("number evictions incorrect, expected 5, got %v", s.metrics.CapacityEvictions)
+	}
+}
+
+func TestTrySetCache_Nil(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	if s.TrySetCache("t1", "s1", nil) {
+		t.Errorf("TrySetCache cached a nil input")
+	}
+	s.SetCacheBatch([]CacheEntry{{TransformID: "t1", SideInputID: "s1"}})
+	if output, status := s.QueryCacheWithStatus("t1", "s1"); output != nil || status != MissCold {
+		t.Errorf("QueryCacheWithStatus after nil set incorrect, expected nil and MissCold, got %v and %v", output, status)
+	}
+	if s.metrics.NilRejections != 2 {
+		t.Errorf("number of nil rejections incorrect, expected 2, got %v", s.metrics.NilRejections)
 	}
 }
 
@@ -287,3 +843,2880 @@ func TestSetCache_EvictionFailure(t *testing.T) {
 		t.Errorf("number of failed evicition calls incorrect, expected 1, got %v", s.metrics.InUseEvictions)
 	}
 }
+
+func TestWithStarvationAlert(t *testing.T) {
+	var s SideInputCache
+	alerts := 0
+	err := s.Init(1, WithStarvationAlert(2, func() {
+		alerts++
+		// The alert must be able to re-enter the cache without deadlocking.
+		s.Metrics()
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if alerts != 0 {
+		t.Errorf("number of alerts incorrect, expected 0, got %v", alerts)
+	}
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if alerts != 1 {
+		t.Errorf("number of alerts incorrect, expected 1, got %v", alerts)
+	}
+	if m := s.Metrics(); m.ConsecutiveInUseEvictions != 3 {
+		t.Errorf("number of consecutive in use evictions incorrect, expected 3, got %v", m.ConsecutiveInUseEvictions)
+	}
+
+	s.CompleteBundle(tokOne)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if m := s.Metrics(); m.ConsecutiveInUseEvictions != 0 {
+		t.Errorf("number of consecutive in use evictions incorrect after caching, expected 0, got %v", m.ConsecutiveInUseEvictions)
+	}
+	if alerts != 1 {
+		t.Errorf("number of alerts incorrect, expected 1, got %v", alerts)
+	}
+}
+
+func TestWithUnderSizedCallback(t *testing.T) {
+	var s SideInputCache
+	var ratios []float64
+	err := s.Init(1, WithUnderSizedCallback(4, 0.75, func(ratio float64) {
+		ratios = append(ratios, ratio)
+		// The callback must be able to re-enter the cache without deadlocking.
+		s.Metrics()
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	// Fill the window with in-use evictions.
+	for i := 0; i < 4; i++ {
+		s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	}
+	if len(ratios) != 1 || ratios[0] != 0.75 {
+		t.Errorf("callback ratios incorrect, expected [0.75], got %v", ratios)
+	}
+
+	// Drop below the threshold, then cross it again.
+	s.CompleteBundle(tokOne)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 21))
+	if len(ratios) != 1 {
+		t.Errorf("callback invoked again before ratio dropped below threshold, got %v", ratios)
+	}
+	s.SetValidTokens(makeRequest("t3", "s3", "tok3"))
+	for i := 0; i < 3; i++ {
+		s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	}
+	if len(ratios) != 2 || ratios[1] != 0.75 {
+		t.Errorf("callback ratios incorrect, expected [0.75 0.75], got %v", ratios)
+	}
+}
+
+func TestSetCacheWeighted(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(4)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCacheWeighted("t2", "s2", makeTestReusableInput("t2", "s2", 20), 2)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	if s.used != 4 {
+		t.Errorf("capacity used incorrect, expected 4, got %v", s.used)
+	}
+	s.CompleteBundle(tokOne, tokTwo)
+
+	// Both completed entries are evicted to free three units.
+	tokFour := makeRequest("t4", "s4", "tok4")
+	s.SetValidTokens(tokFour)
+	s.SetCacheWeighted("t4", "s4", makeTestReusableInput("t4", "s4", 40), 3)
+	if s.metrics.CapacityEvictions != 2 {
+		t.Errorf("number of evictions incorrect, expected 2, got %v", s.metrics.CapacityEvictions)
+	}
+	if s.used != 4 || len(s.cache) != 2 {
+		t.Errorf("cache contents incorrect, expected 2 entries using 4 units, got %v entries using %v", len(s.cache), s.used)
+	}
+
+	// Nothing is evictable, so no room can be made for even a single unit.
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if s.metrics.InUseEvictions != 0 {
+		t.Errorf("number of in use evictions incorrect, expected 0, got %v", s.metrics.InUseEvictions)
+	}
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if s.metrics.InUseEvictions != 1 {
+		t.Errorf("number of in use evictions incorrect, expected 1, got %v", s.metrics.InUseEvictions)
+	}
+
+	// An input heavier than the whole cache is rejected outright.
+	s.SetCacheWeighted("t1", "s1", makeTestReusableInput("t1", "s1", 10), 5)
+	if s.metrics.OversizedRejections != 1 {
+		t.Errorf("number of oversized rejections incorrect, expected 1, got %v", s.metrics.OversizedRejections)
+	}
+}
+
+func TestSetCache_OverflowBuffer(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithOverflowBuffer(1))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	// Exceeds capacity, since the first token is still valid
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect, expected 2, got %v", len(s.cache))
+	}
+	// The overflow buffer is full
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect, expected 2, got %v", len(s.cache))
+	}
+	if s.metrics.InUseEvictions != 1 {
+		t.Errorf("number of in use evictions incorrect, expected 1, got %v", s.metrics.InUseEvictions)
+	}
+
+	s.CompleteBundle(tokOne, tokTwo)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	// Both completed entries are evicted to bring the cache back within capacity
+	if len(s.cache) != 1 {
+		t.Errorf("cache size incorrect, expected 1, got %v", len(s.cache))
+	}
+	if got := s.QueryCache("t3", "s3"); got == nil {
+		t.Errorf("input not cached after overflow entries became evictable")
+	}
+}
+
+func TestSetCache_EvictionLRU(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	// Touch the first entry so that the second is the least recently used.
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Fatalf("call to query cache missed when should have hit")
+	}
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokThree)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+
+	if _, ok := s.cache[CacheKey{TransformID: "t2", SideInputID: "s2"}]; ok {
+		t.Errorf("least recently used entry tok2 was not evicted")
+	}
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("recently used entry tok1 was evicted")
+	}
+	if s.metrics.CapacityEvictions != 1 {
+		t.Errorf("number evictions incorrect, expected 1, got %v", s.metrics.CapacityEvictions)
+	}
+}
+
+func TestSetCache_EvictionSkipsValid(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	// Only the most recently used entry becomes evictable.
+	s.CompleteBundle(tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("in use entry tok1 was evicted")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t2", SideInputID: "s2"}]; ok {
+		t.Errorf("evictable entry tok2 was not evicted")
+	}
+	if s.metrics.InUseEvictions != 0 {
+		t.Errorf("number of in use evictions incorrect, expected 0, got %v", s.metrics.InUseEvictions)
+	}
+}
+
+func sizeOfTestInput(r ReusableInput) int64 {
+	return int64(r.Value().(int))
+}
+
+func TestInitWithByteLimit_Bad(t *testing.T) {
+	var s SideInputCache
+	if err := s.InitWithByteLimit(0, sizeOfTestInput); !errors.Is(err, ErrInvalidCapacity) {
+		t.Errorf("SideInputCache init with zero byte limit error incorrect, expected ErrInvalidCapacity, got %v", err)
+	}
+	if err := s.InitWithByteLimit(10, nil); err == nil {
+		t.Error("SideInputCache init succeeded with nil sizer but should have failed")
+	}
+}
+
+func TestSetCache_ByteLimitEviction(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(50, sizeOfTestInput)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 20))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if s.metrics.BytesInUse != 40 {
+		t.Errorf("bytes in use incorrect, expected 40, got %v", s.metrics.BytesInUse)
+	}
+	s.CompleteBundle(tokOne, tokTwo)
+
+	// Needs both existing entries evicted to fit.
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 45))
+
+	if len(s.cache) != 1 {
+		t.Errorf("cache size incorrect, expected 1, got %v", len(s.cache))
+	}
+	if s.metrics.CapacityEvictions != 2 {
+		t.Errorf("number evictions incorrect, expected 2, got %v", s.metrics.CapacityEvictions)
+	}
+	if s.metrics.BytesInUse != 45 {
+		t.Errorf("bytes in use incorrect, expected 45, got %v", s.metrics.BytesInUse)
+	}
+}
+
+func TestSetCache_ByteLimitEvictionFailure(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(50, sizeOfTestInput)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 30))
+	// Should fail to evict because the first token is still valid
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 30))
+
+	if len(s.cache) != 1 {
+		t.Errorf("cache size incorrect, expected 1, got %v", len(s.cache))
+	}
+	if s.metrics.BytesInUse != 30 {
+		t.Errorf("bytes in use incorrect, expected 30, got %v", s.metrics.BytesInUse)
+	}
+	if s.metrics.InUseEvictions != 1 {
+		t.Errorf("number of in use evictions incorrect, expected 1, got %v", s.metrics.InUseEvictions)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.QueryCache("t1", "s1")
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.QueryCache("t1", "s1")
+	s.CompleteBundle(tok)
+
+	m := s.Metrics()
+	if m.Hits != 2 {
+		t.Errorf("number of hits incorrect, expected 2, got %v", m.Hits)
+	}
+	if m.Misses != 1 {
+		t.Errorf("number of misses incorrect, expected 1, got %v", m.Misses)
+	}
+	if m.CompleteBundles != 1 {
+		t.Errorf("number of completed bundles incorrect, expected 1, got %v", m.CompleteBundles)
+	}
+}
+
+func TestSideInputCache_Concurrent(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(5)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				transID := fmt.Sprintf("t%v", j%10)
+				sideID := fmt.Sprintf("s%v", i)
+				tok := makeRequest(transID, sideID, token(transID+sideID))
+				s.SetValidTokens(tok)
+				if s.QueryCache(transID, sideID) == nil {
+					s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, j))
+				}
+				s.Metrics()
+				s.CompleteBundle(tok)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(s.cache) > 5 {
+		t.Errorf("cache size exceeded capacity, expected at most 5, got %v", len(s.cache))
+	}
+	if len(s.validTokens) != 0 {
+		t.Errorf("valid tokens remaining after all bundles completed, got %v", s.validTokens)
+	}
+}
+
+func TestMetrics_ConcurrentReader(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	const queries = 500
+	done := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		var last int64
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			m := s.Metrics()
+			n := m.Hits + m.Misses
+			if n < last {
+				t.Errorf("queries counted went backwards, expected at least %v, got %v", last, n)
+				return
+			}
+			last = n
+		}
+	}()
+	for i := 0; i < queries; i++ {
+		transID := fmt.Sprintf("t%v", i%4)
+		tok := makeRequest(transID, "s1", token(transID))
+		s.SetValidTokens(tok)
+		if s.QueryCache(transID, "s1") == nil {
+			s.SetCache(transID, "s1", makeTestReusableInput(transID, "s1", i))
+		}
+		s.CompleteBundle(tok)
+	}
+	close(done)
+	<-readerDone
+
+	m := s.Metrics()
+	if got := m.Hits + m.Misses; got != queries {
+		t.Errorf("number of queries incorrect, expected %v, got %v", queries, got)
+	}
+	if m.CompleteBundles != queries {
+		t.Errorf("number of completed bundles incorrect, expected %v, got %v", queries, m.CompleteBundles)
+	}
+}
+
+func TestStats(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	for i := 1; i <= 4; i++ {
+		transID, sideID := fmt.Sprintf("t%d", i), fmt.Sprintf("s%d", i)
+		tok := makeRequest(transID, sideID, token(fmt.Sprintf("tok%d", i)))
+		s.SetValidTokens(tok)
+		s.QueryCache(transID, sideID)
+		s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, i))
+		s.QueryCache(transID, sideID)
+		s.QueryCache(transID, sideID)
+		s.CompleteBundle(tok)
+	}
+	s.Invalidate("t4", "s4")
+
+	st := s.Stats()
+	m := st.Metrics
+	if st.Entries != 1 || st.Capacity != 2 || st.ByteLimit != 0 {
+		t.Errorf("occupancy incorrect, expected 1 entry of capacity 2, got %v of %v and byte limit %v", st.Entries, st.Capacity, st.ByteLimit)
+	}
+	if want := float64(st.Entries) / float64(st.Capacity); st.Utilization != want {
+		t.Errorf("utilization incorrect, expected %v, got %v", want, st.Utilization)
+	}
+	if m.Hits != 8 || m.Misses != 4 {
+		t.Errorf("queries incorrect, expected 8 hits and 4 misses, got %v and %v", m.Hits, m.Misses)
+	}
+	if want := float64(m.Hits) / float64(m.Hits+m.Misses); st.HitRatio != want {
+		t.Errorf("hit ratio incorrect, expected %v, got %v", want, st.HitRatio)
+	}
+	if m.CapacityEvictions != 2 || m.ManualInvalidations != 1 {
+		t.Errorf("eviction breakdown incorrect, expected 2 capacity evictions and 1 invalidation, got %v and %v", m.CapacityEvictions, m.ManualInvalidations)
+	}
+	if m.TotalEvictions != m.CapacityEvictions+m.ManualInvalidations {
+		t.Errorf("total evictions inconsistent with breakdown, got %v", m.TotalEvictions)
+	}
+	if m.PeakEntries != 2 || int64(st.Entries) > m.PeakEntries {
+		t.Errorf("peak entries incorrect, expected 2, got %v", m.PeakEntries)
+	}
+	if !reflect.DeepEqual(m, s.Metrics()) {
+		t.Errorf("stats metrics differ from Metrics, got %+v and %+v", m, s.Metrics())
+	}
+
+	var empty SideInputCache
+	if got := empty.Stats(); got.HitRatio != 0 || got.Utilization != 0 || got.Entries != 0 {
+		t.Errorf("stats of uninitialized cache incorrect, got %+v", got)
+	}
+}
+
+func TestMetrics_ReturnsCopy(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.QueryCache("t1", "s1")
+
+	m := s.Metrics()
+	m.Misses = 100
+	m.Hits = 100
+	if s.metrics.Misses != 1 {
+		t.Errorf("number of misses changed by mutating returned metrics, expected 1, got %v", s.metrics.Misses)
+	}
+	if got := s.Metrics(); got.Hits != 0 || got.Misses != 1 {
+		t.Errorf("metrics incorrect after mutating returned copy, expected 0 hits and 1 miss, got %v and %v", got.Hits, got.Misses)
+	}
+}
+
+func TestQueryCache_TTL(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Fatalf("call to query cache missed when should have hit")
+	}
+
+	// Age the entry past the TTL.
+	s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}].inserted = time.Now().Add(-2 * time.Minute)
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("Cache hit on expired entry, got %v", output)
+	}
+	if len(s.cache) != 0 {
+		t.Errorf("expired entry not removed, cache size %v", len(s.cache))
+	}
+	if s.metrics.Expirations != 1 {
+		t.Errorf("number of expirations incorrect, expected 1, got %v", s.metrics.Expirations)
+	}
+	if s.metrics.CapacityEvictions != 0 {
+		t.Errorf("number evictions incorrect, expected 0, got %v", s.metrics.CapacityEvictions)
+	}
+}
+
+func TestQueryCacheWithRetryAfter(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithMissBackoff(time.Second, 5*time.Second))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if _, status, got := s.QueryCacheWithRetryAfter("t1", "s1"); status != MissInvalidToken || got != want {
+			t.Errorf("QueryCacheWithRetryAfter returned incorrect hint, expected %v with %v, got %v with %v", MissInvalidToken, want, status, got)
+		}
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if _, status, got := s.QueryCacheWithRetryAfter("t1", "s1"); status != Hit || got != 0 {
+		t.Errorf("QueryCacheWithRetryAfter returned incorrect hint, expected %v with 0, got %v with %v", Hit, status, got)
+	}
+	s.CompleteBundle(tok)
+	if _, _, got := s.QueryCacheWithRetryAfter("t1", "s1"); got != time.Second {
+		t.Errorf("QueryCacheWithRetryAfter hint not reset by hit, expected %v, got %v", time.Second, got)
+	}
+}
+
+func TestQueryCacheWithRetryAfter_Disabled(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.QueryCache("t1", "s1")
+	if _, _, got := s.QueryCacheWithRetryAfter("t1", "s1"); got != 0 {
+		t.Errorf("QueryCacheWithRetryAfter returned hint with backoff disabled, got %v", got)
+	}
+}
+
+func TestWithCopyOnRead(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithCopyOnRead(func(in ReusableInput) ReusableInput {
+		c := *in.(*TestReusableInput)
+		return &c
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	input := makeTestReusableInput("t1", "s1", 10)
+	s.SetCache("t1", "s1", input)
+	first := s.QueryCache("t1", "s1")
+	second := s.QueryCache("t1", "s1")
+	if first == input || second == input || first == second {
+		t.Errorf("query returned a shared instance, got %p and %p for cached %p", first, second, input)
+	}
+	if !reflect.DeepEqual(first, input) {
+		t.Errorf("query returned incorrect copy, expected %v, got %v", input, first)
+	}
+	first.(*TestReusableInput).value = 11
+	if got := s.QueryCache("t1", "s1").Value(); got != 10 {
+		t.Errorf("cached input changed by mutating a queried copy, got %v", got)
+	}
+}
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestQueryCache_TTLFakeClock(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(1, WithTTL(time.Minute), WithClock(clk))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	clk.advance(time.Minute)
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("call to query cache missed at exactly the TTL when should have hit")
+	}
+	clk.advance(time.Nanosecond)
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("call to query cache hit past the TTL when should have missed, got %v", output)
+	}
+	if s.metrics.Expirations != 1 {
+		t.Errorf("number of expirations incorrect, expected 1, got %v", s.metrics.Expirations)
+	}
+}
+
+func TestMetrics_AverageEntryLifetime(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(1, WithClock(clk))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if got := s.Metrics().AverageEntryLifetime(); got != 0 {
+		t.Errorf("average entry lifetime incorrect, expected 0, got %v", got)
+	}
+
+	for i, life := range []time.Duration{time.Second, 3 * time.Second} {
+		id := fmt.Sprint(i)
+		tok := makeRequest("t"+id, "s"+id, token("tok"+id))
+		s.SetValidTokens(tok)
+		s.SetCache("t"+id, "s"+id, makeTestReusableInput("t"+id, "s"+id, i))
+		s.CompleteBundle(tok)
+		clk.advance(life)
+	}
+	// Evicts the second entry, after the first was evicted to cache the second.
+	s.SetValidTokens(makeRequest("t2", "s2", "tok2"))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 2))
+
+	m := s.Metrics()
+	if m.LifetimeSamples != 2 {
+		t.Errorf("number of lifetime samples incorrect, expected 2, got %v", m.LifetimeSamples)
+	}
+	if got, want := m.AverageEntryLifetime(), 2*time.Second; got != want {
+		t.Errorf("average entry lifetime incorrect, expected %v, got %v", want, got)
+	}
+}
+
+func TestTokenRefCounts_FakeClock(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(1, WithStuckTokenAge(time.Hour), WithClock(clk))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	if counts := s.TokenRefCounts(); len(counts) != 1 || !counts[0].Since.Equal(clk.now) {
+		t.Errorf("token ref counts incorrect, expected tok1 valid since %v, got %v", clk.now, counts)
+	}
+	clk.advance(time.Hour + time.Second)
+	if m := s.Metrics(); m.StuckTokens != 1 {
+		t.Errorf("number of stuck tokens incorrect, expected 1, got %v", m.StuckTokens)
+	}
+}
+
+// failingReusableInput is a TestReusableInput whose Init fails.
+type failingReusableInput struct {
+	TestReusableInput
+	err error
+}
+
+func (f *failingReusableInput) Init() error {
+	return f.err
+}
+
+func TestContains(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	if s.Contains("t1", "s1") {
+		t.Errorf("Contains reported an input with no valid token")
+	}
+	s.SetValidTokens(tokOne, tokTwo)
+	if s.Contains("t1", "s1") {
+		t.Errorf("Contains reported an uncached input")
+	}
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if !s.Contains("t1", "s1") {
+		t.Errorf("Contains did not report a cached input")
+	}
+	if s.metrics.Hits != 0 || s.metrics.Misses != 0 {
+		t.Errorf("Contains counted queries, got %v hits and %v misses", s.metrics.Hits, s.metrics.Misses)
+	}
+
+	// t1 stays least recently used, so it is evicted first.
+	s.CompleteBundle(tokOne, tokTwo)
+	s.SetValidTokens(makeRequest("t3", "s3", "tok3"))
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; ok {
+		t.Errorf("Contains updated the recency of t1, which was not evicted")
+	}
+}
+
+func TestQueryCacheWithInit(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t2", "s2", "tok2"))
+	in := makeTestReusableInput("t1", "s1", 10)
+	s.SetCache("t1", "s1", in)
+	if output, status, err := s.QueryCacheWithInit("t1", "s1"); output != in || status != Hit || err != nil {
+		t.Errorf("QueryCacheWithInit incorrect, expected %v, Hit, and no error, got %v, %v, and %v", in, output, status, err)
+	}
+
+	initErr := errors.New("failed to open stream")
+	s.SetCache("t2", "s2", &failingReusableInput{err: initErr})
+	output, status, err := s.QueryCacheWithInit("t2", "s2")
+	if output != nil || status != MissInitFailed {
+		t.Errorf("QueryCacheWithInit incorrect, expected nil and MissInitFailed, got %v and %v", output, status)
+	}
+	if !errors.Is(err, initErr) {
+		t.Errorf("QueryCacheWithInit error incorrect, expected %v, got %v", initErr, err)
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t2", SideInputID: "s2"}]; ok {
+		t.Errorf("entry failing to initialize was not removed")
+	}
+	if s.metrics.InitFailures != 1 {
+		t.Errorf("number of init failures incorrect, expected 1, got %v", s.metrics.InitFailures)
+	}
+	if m := s.Metrics(); m.Hits != 1 || m.Misses != 1 {
+		t.Errorf("query metrics incorrect, expected 1 hit and 1 miss, got %v and %v", m.Hits, m.Misses)
+	}
+	if st := s.BundleStats([]byte("tok2")); st.Hits != 0 || st.Misses != 1 {
+		t.Errorf("bundle stats incorrect, expected 0 hits and 1 miss, got %v and %v", st.Hits, st.Misses)
+	}
+	if _, status, err := s.QueryCacheWithInit("t2", "s2"); status != MissEvicted || err != nil {
+		t.Errorf("QueryCacheWithInit after removal incorrect, expected MissEvicted and no error, got %v and %v", status, err)
+	}
+}
+
+func TestQueryCacheStale(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(2, WithTTL(time.Minute), WithClock(clk), WithAllowStale())
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tok, tokTwo)
+	inOne := makeTestReusableInput("t1", "s1", 10)
+	inTwo := makeTestReusableInput("t2", "s2", 20)
+	s.SetCache("t1", "s1", inOne)
+	if in, fresh := s.QueryCacheStale("t1", "s1"); in != inOne || !fresh {
+		t.Errorf("QueryCacheStale incorrect, expected %v and fresh, got %v and %v", inOne, in, fresh)
+	}
+	s.SetCache("t2", "s2", inTwo)
+	clk.advance(2 * time.Minute)
+	if in, fresh := s.QueryCacheStale("t1", "s1"); in != inOne || fresh {
+		t.Errorf("QueryCacheStale of expired input incorrect, expected %v and stale, got %v and %v", inOne, in, fresh)
+	}
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("call to query cache hit an expired input, got %v", output)
+	}
+	s.Invalidate("t2", "s2")
+	if in, fresh := s.QueryCacheStale("t2", "s2"); in != inTwo || fresh {
+		t.Errorf("QueryCacheStale of invalidated input incorrect, expected %v and stale, got %v and %v", inTwo, in, fresh)
+	}
+
+	// Stale inputs are evictable even though their tokens are still valid.
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	if !s.TrySetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30)) {
+		t.Errorf("TrySetCache failed with only stale inputs cached")
+	}
+
+	// A refresh replaces the stale input.
+	refreshed := makeTestReusableInput("t1", "s1", 11)
+	s.SetCache("t1", "s1", refreshed)
+	if in, fresh := s.QueryCacheStale("t1", "s1"); in != refreshed || !fresh {
+		t.Errorf("QueryCacheStale after refresh incorrect, expected %v and fresh, got %v and %v", refreshed, in, fresh)
+	}
+}
+
+func TestQueryCacheStale_ExpiredCountedOnce(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(1, WithTTL(time.Minute), WithClock(clk), WithAllowStale())
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t2", "s2", "tok2"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	clk.advance(2 * time.Minute)
+	s.QueryCache("t1", "s1")
+	if m := s.Metrics(); m.Expirations != 0 || m.TotalEvictions != 0 {
+		t.Errorf("evictions of expired entry kept as stale incorrect, expected 0 and 0, got %v and %v", m.Expirations, m.TotalEvictions)
+	}
+
+	// The stale entry is counted once, when evicted for capacity.
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if m := s.Metrics(); m.Expirations != 0 || m.CapacityEvictions != 1 || m.TotalEvictions != 1 {
+		t.Errorf("evictions of stale entry incorrect, expected 0 expirations and 1 capacity eviction of 1 in total, got %v, %v and %v", m.Expirations, m.CapacityEvictions, m.TotalEvictions)
+	}
+}
+
+func TestQueryCacheStale_NotAllowed(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.Invalidate("t1", "s1")
+	if in, fresh := s.QueryCacheStale("t1", "s1"); in != nil || fresh {
+		t.Errorf("QueryCacheStale returned stale input without WithAllowStale, got %v and %v", in, fresh)
+	}
+}
+
+func TestQueryCache_NoTTL(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}].inserted = time.Now().Add(-24 * time.Hour)
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("call to query cache missed when should have hit")
+	}
+}
+
+func TestQueryCache_SupersededToken(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+
+	// The side input is now valid under tok2, while the bundle holding tok1 is still active.
+	s.SetValidTokens(makeRequest("t1", "s1", "tok2"))
+	in, status := s.QueryCacheWithStatus("t1", "s1")
+	if in != nil || status != MissCold {
+		t.Errorf("query under superseded token incorrect, expected nil and %v, got %v and %v", MissCold, in, status)
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; ok {
+		t.Errorf("entry cached under superseded token not evicted")
+	}
+	if m := s.Metrics(); m.SupersededEvictions != 1 || m.TotalEvictions != 1 {
+		t.Errorf("superseded evictions incorrect, expected 1 counted in total evictions, got %v and %v", m.SupersededEvictions, m.TotalEvictions)
+	}
+}
+
+func TestQueryCache_SupersededTokenAllowStale(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithAllowStale())
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetValidTokens(makeRequest("t1", "s1", "tok2"))
+	s.QueryCache("t1", "s1")
+	if m := s.Metrics(); m.SupersededEvictions != 0 || m.TotalEvictions != 0 {
+		t.Errorf("evictions of superseded entry kept as stale incorrect, expected 0 and 0, got %v and %v", m.SupersededEvictions, m.TotalEvictions)
+	}
+
+	// The stale entry is counted once, when evicted for capacity.
+	s.SetValidTokens(makeRequest("t2", "s2", "tok3"))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if m := s.Metrics(); m.CapacityEvictions != 1 || m.TotalEvictions != 1 {
+		t.Errorf("evictions of stale entry incorrect, expected 1 capacity eviction of 1 in total, got %v and %v", m.CapacityEvictions, m.TotalEvictions)
+	}
+}
+
+func TestQueryByToken(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCacheEmpty("t2", "s2")
+
+	if in, ok := s.QueryByToken(tokOne); !ok || in.Value() != 10 {
+		t.Errorf("QueryByToken(tok1) incorrect, expected 10 and true, got %v and %v", in, ok)
+	}
+	if in, ok := s.QueryByToken(tokTwo); !ok || in != nil {
+		t.Errorf("QueryByToken(tok2) incorrect, expected nil and true for an empty side input, got %v and %v", in, ok)
+	}
+	if in, ok := s.QueryByToken(makeRequest("t1", "s1", "tok3")); ok || in != nil {
+		t.Errorf("QueryByToken with superseded token incorrect, expected nil and false, got %v and %v", in, ok)
+	}
+	if in, ok := s.QueryByToken(makeUserStateRequest("tok1")); ok || in != nil {
+		t.Errorf("QueryByToken with user state token incorrect, expected nil and false, got %v and %v", in, ok)
+	}
+
+	s.CompleteBundle(tokOne, tokTwo)
+	if in, ok := s.QueryByToken(tokOne); ok || in != nil {
+		t.Errorf("QueryByToken with completed token incorrect, expected nil and false, got %v and %v", in, ok)
+	}
+}
+
+func TestQueryCacheWithStatus(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	if _, status := s.QueryCacheWithStatus("t1", "s1"); status != MissInvalidToken {
+		t.Errorf("status for unknown token incorrect, expected %v, got %v", MissInvalidToken, status)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	if _, status := s.QueryCacheWithStatus("t1", "s1"); status != MissCold {
+		t.Errorf("status for uncached input incorrect, expected %v, got %v", MissCold, status)
+	}
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if output, status := s.QueryCacheWithStatus("t1", "s1"); status != Hit || output == nil {
+		t.Errorf("status for cached input incorrect, expected %v, got %v with value %v", Hit, status, output)
+	}
+	s.CompleteBundle(tokOne)
+	if _, status := s.QueryCacheWithStatus("t1", "s1"); status != MissInvalidToken {
+		t.Errorf("status for completed token incorrect, expected %v, got %v", MissInvalidToken, status)
+	}
+
+	// Evict the first input by caching a second one.
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetValidTokens(tokOne)
+	if _, status := s.QueryCacheWithStatus("t1", "s1"); status != MissEvicted {
+		t.Errorf("status for evicted input incorrect, expected %v, got %v", MissEvicted, status)
+	}
+}
+
+func TestSetCacheBatch(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	tokFour := makeRequest("t4", "s4", "tok4")
+	s.SetValidTokens(tokOne, tokThree, tokFour)
+	s.SetCacheBatch([]CacheEntry{
+		{TransformID: "t1", SideInputID: "s1", Input: makeTestReusableInput("t1", "s1", 11)},
+		{TransformID: "t3", SideInputID: "s3", Input: makeTestReusableInput("t3", "s3", 30)},
+		{TransformID: "t4", SideInputID: "s4", Input: makeTestReusableInput("t4", "s4", 40)},
+		// Uncacheable, so it is skipped.
+		{TransformID: "t5", SideInputID: "s5", Input: makeTestReusableInput("t5", "s5", 50)},
+	})
+
+	if len(s.cache) != 3 {
+		t.Errorf("cache size incorrect, expected 3, got %v", len(s.cache))
+	}
+	// Only tok2 needed to be evicted, as tok1 was replaced in place.
+	if s.metrics.CapacityEvictions != 1 {
+		t.Errorf("number evictions incorrect, expected 1, got %v", s.metrics.CapacityEvictions)
+	}
+	output := s.QueryCache("t1", "s1")
+	if output == nil {
+		t.Fatalf("call to query cache missed when should have hit")
+	}
+	if val := output.Value().(int); val != 11 {
+		t.Errorf("element mismatch, expected 11, got %v", val)
+	}
+}
+
+func TestSetCacheBatch_Overflow(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	s.SetCacheBatch([]CacheEntry{
+		{TransformID: "t1", SideInputID: "s1", Input: makeTestReusableInput("t1", "s1", 10)},
+		{TransformID: "t2", SideInputID: "s2", Input: makeTestReusableInput("t2", "s2", 20)},
+		{TransformID: "t3", SideInputID: "s3", Input: makeTestReusableInput("t3", "s3", 30)},
+	})
+
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect, expected 2, got %v", len(s.cache))
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t3", SideInputID: "s3"}]; ok {
+		t.Errorf("entry beyond capacity was cached")
+	}
+	if s.metrics.InUseEvictions != 1 {
+		t.Errorf("number of in use evictions incorrect, expected 1, got %v", s.metrics.InUseEvictions)
+	}
+}
+
+func TestClear(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.Clear()
+
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("Cache hit after Clear, got %v", output)
+	}
+	if output := s.QueryCache("t2", "s2"); output != nil {
+		t.Errorf("Cache hit after Clear, got %v", output)
+	}
+	if len(s.validTokens) != 0 || len(s.idsToTokens) != 0 {
+		t.Errorf("tokens remaining after Clear, got %v and %v", s.validTokens, s.idsToTokens)
+	}
+	if s.metrics.Flushes != 2 {
+		t.Errorf("number of flushes incorrect, expected 2, got %v", s.metrics.Flushes)
+	}
+
+	// The cache remains usable with the same capacity.
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect, expected 2, got %v", len(s.cache))
+	}
+}
+
+func TestWithEvictionCallback(t *testing.T) {
+	var s SideInputCache
+	var evicted []string
+	err := s.Init(1, WithEvictionCallback(func(transformID, sideInputID string, in ReusableInput) {
+		evicted = append(evicted, transformID+sideInputID)
+		// The callback must be able to re-enter the cache without deadlocking.
+		s.Metrics()
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	// Replacing an entry invokes the callback for the replaced input.
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 11))
+	if len(evicted) != 1 || evicted[0] != "t1s1" {
+		t.Errorf("eviction callback invocations incorrect, expected [t1s1], got %v", evicted)
+	}
+	s.CompleteBundle(tokOne)
+
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if len(evicted) != 2 || evicted[1] != "t1s1" {
+		t.Errorf("eviction callback invocations incorrect, expected [t1s1 t1s1], got %v", evicted)
+	}
+
+	s.Clear()
+	if len(evicted) != 3 || evicted[2] != "t2s2" {
+		t.Errorf("eviction callback invocations incorrect, expected [t1s1 t1s1 t2s2], got %v", evicted)
+	}
+}
+
+// closingReusableInput is a TestReusableInput that counts calls to Close.
+type closingReusableInput struct {
+	TestReusableInput
+	closes int
+	err    error
+}
+
+func (c *closingReusableInput) Close() error {
+	c.closes++
+	return c.err
+}
+
+func TestEvictionClosesInput(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	var log bytes.Buffer
+	s.SetEventLog(&log)
+
+	inOne := &closingReusableInput{err: errors.New("stream already closed")}
+	inTwo := &closingReusableInput{}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", inOne)
+	s.CompleteBundle(tokOne)
+
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	s.SetCache("t2", "s2", inTwo)
+	if inOne.closes != 1 {
+		t.Errorf("number of closes of evicted input incorrect, expected 1, got %v", inOne.closes)
+	}
+	if inTwo.closes != 0 {
+		t.Errorf("cached input closed, got %v closes", inTwo.closes)
+	}
+	if !strings.Contains(log.String(), `close "t1" "s1" "tok1" "stream already closed"`) {
+		t.Errorf("event log missing close error, got %q", log.String())
+	}
+
+	s.Clear()
+	s.Clear()
+	if inTwo.closes != 1 {
+		t.Errorf("number of closes of cleared input incorrect, expected 1, got %v", inTwo.closes)
+	}
+	if inOne.closes != 1 {
+		t.Errorf("number of closes of evicted input incorrect after Clear, expected 1, got %v", inOne.closes)
+	}
+}
+
+func TestReplaceClosesInput(t *testing.T) {
+	var s SideInputCache
+	var evicted []ReusableInput
+	err := s.Init(2, WithEvictionCallback(func(transformID, sideInputID string, in ReusableInput) {
+		evicted = append(evicted, in)
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	inOne := &closingReusableInput{}
+	inTwo := &closingReusableInput{}
+	inThree := &closingReusableInput{}
+	s.SetCache("t1", "s1", inOne)
+	// Caching the same input again does not close it.
+	s.SetCache("t1", "s1", inOne)
+	if inOne.closes != 0 {
+		t.Errorf("input closed when cached again, got %v closes", inOne.closes)
+	}
+	s.SetCacheWeighted("t1", "s1", inTwo, 2)
+	s.SetCacheBatch([]CacheEntry{{TransformID: "t1", SideInputID: "s1", Input: inThree}})
+	s.SetCacheEmpty("t1", "s1")
+	for i, in := range []*closingReusableInput{inOne, inTwo, inThree} {
+		if in.closes != 1 {
+			t.Errorf("number of closes of replaced input %v incorrect, expected 1, got %v", i+1, in.closes)
+		}
+	}
+	if len(evicted) != 3 {
+		t.Errorf("number of replaced inputs passed to the eviction callback incorrect, expected 3, got %v", len(evicted))
+	}
+}
+
+func TestPin(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.Pin("t1", "s1")
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.CompleteBundle(tokOne, tokTwo)
+
+	// The pinned entry is least recently used, but only the other entry may be evicted.
+	tokThree := makeRequest("t3", "s3", "tok3")
+	tokFour := makeRequest("t4", "s4", "tok4")
+	s.SetValidTokens(tokThree, tokFour)
+	if !s.TrySetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30)) {
+		t.Errorf("TrySetCache failed with an evictable entry cached")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("pinned entry evicted")
+	}
+	// The cache now holds only pinned and in-use entries.
+	if s.TrySetCache("t4", "s4", makeTestReusableInput("t4", "s4", 40)) {
+		t.Errorf("TrySetCache succeeded with only pinned and in use entries cached")
+	}
+	if m := s.Metrics(); m.PinnedEntries != 1 {
+		t.Errorf("number of pinned entries incorrect, expected 1, got %v", m.PinnedEntries)
+	}
+
+	s.Unpin("t1", "s1")
+	if !s.TrySetCache("t4", "s4", makeTestReusableInput("t4", "s4", 40)) {
+		t.Errorf("TrySetCache failed after unpinning an evictable entry")
+	}
+	if m := s.Metrics(); m.PinnedEntries != 0 {
+		t.Errorf("number of pinned entries incorrect, expected 0, got %v", m.PinnedEntries)
+	}
+}
+
+func TestSetTransformQuota(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetTransformQuota("greedy", 1)
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("greedy", "s2", "tok2")
+	tokThree := makeRequest("greedy", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	// t1 is the least recently used entry.
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("greedy", "s2", makeTestReusableInput("greedy", "s2", 20))
+	s.SetCache("greedy", "s3", makeTestReusableInput("greedy", "s3", 30))
+	s.CompleteBundle(tokOne, tokTwo, tokThree)
+
+	tokFour := makeRequest("t4", "s4", "tok4")
+	s.SetValidTokens(tokFour)
+	s.SetCache("t4", "s4", makeTestReusableInput("t4", "s4", 40))
+
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("entry of transform within quota was evicted")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "greedy", SideInputID: "s2"}]; ok {
+		t.Errorf("least recently used entry of over-quota transform was not evicted")
+	}
+	if s.metrics.QuotaEvictions != 1 {
+		t.Errorf("number of quota evictions incorrect, expected 1, got %v", s.metrics.QuotaEvictions)
+	}
+
+	// With the greedy transform back within quota, plain LRU eviction applies.
+	tokFive := makeRequest("t5", "s5", "tok5")
+	s.SetValidTokens(tokFive)
+	s.SetCache("t5", "s5", makeTestReusableInput("t5", "s5", 50))
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; ok {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	if s.metrics.QuotaEvictions != 1 {
+		t.Errorf("number of quota evictions incorrect, expected 1, got %v", s.metrics.QuotaEvictions)
+	}
+}
+
+func TestSetCacheEx(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	for _, tok := range []fnpb.ProcessBundleRequest_CacheToken{tokOne, tokTwo} {
+		side := tok.GetSideInput()
+		res := s.SetCacheEx(side.GetTransformId(), side.GetSideInputId(), makeTestReusableInput(side.GetTransformId(), side.GetSideInputId(), 10))
+		if !res.Cached || len(res.Evicted) != 0 {
+			t.Errorf("result of filling the cache incorrect, expected cached with no evictions, got %+v", res)
+		}
+	}
+	// Replacing an input is not an eviction.
+	if res := s.SetCacheEx("t1", "s1", makeTestReusableInput("t1", "s1", 20)); !res.Cached || len(res.Evicted) != 0 {
+		t.Errorf("result of replacing an input incorrect, expected cached with no evictions, got %+v", res)
+	}
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	tokFour := makeRequest("t4", "s4", "tok4")
+	tokFive := makeRequest("t5", "s5", "tok5")
+	s.SetValidTokens(tokThree, tokFour, tokFive)
+	want := []CacheKey{{TransformID: "t2", SideInputID: "s2"}}
+	if res := s.SetCacheEx("t3", "s3", makeTestReusableInput("t3", "s3", 30)); !res.Cached || !reflect.DeepEqual(res.Evicted, want) {
+		t.Errorf("result of evicting the least recently used input incorrect, expected cached evicting %v, got %+v", want, res)
+	}
+	want = []CacheKey{{TransformID: "t1", SideInputID: "s1"}}
+	if res := s.SetCacheEx("t4", "s4", makeTestReusableInput("t4", "s4", 40)); !res.Cached || !reflect.DeepEqual(res.Evicted, want) {
+		t.Errorf("result of evicting the last completed input incorrect, expected cached evicting %v, got %+v", want, res)
+	}
+	// Every cached input is now in use.
+	if res := s.SetCacheEx("t5", "s5", makeTestReusableInput("t5", "s5", 50)); res.Cached || len(res.Evicted) != 0 {
+		t.Errorf("result of setting a full cache incorrect, expected uncached with no evictions, got %+v", res)
+	}
+}
+
+func TestTrySetCache(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	if s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10)) {
+		t.Errorf("TrySetCache reported uncacheable input as cached")
+	}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	if !s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10)) {
+		t.Errorf("TrySetCache reported cacheable input as not cached")
+	}
+	// The cache is full of in use entries.
+	if s.TrySetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20)) {
+		t.Errorf("TrySetCache reported input as cached when the cache is full")
+	}
+}
+
+func TestResetMetrics(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(100, sizeOfTestInput)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.QueryCache("t1", "s1")
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.ResetMetrics()
+
+	if m := s.Metrics(); m != (CacheMetrics{BytesInUse: 10, PeakEntries: 1, PeakBytes: 10}) {
+		t.Errorf("metrics not reset, got %+v", m)
+	}
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("call to query cache missed after ResetMetrics when should have hit")
+	}
+	if m := s.Metrics(); m.Hits != 1 {
+		t.Errorf("number of hits incorrect, expected 1, got %v", m.Hits)
+	}
+}
+
+func TestMetrics_EvictionBreakdown(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(2, WithTTL(time.Minute), WithClock(clk))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.Invalidate("t2", "s2")
+	clk.advance(2 * time.Minute)
+	s.QueryCache("t1", "s1")
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	tokFour := makeRequest("t4", "s4", "tok4")
+	tokFive := makeRequest("t5", "s5", "tok5")
+	s.SetValidTokens(tokThree, tokFour)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	s.SetCache("t4", "s4", makeTestReusableInput("t4", "s4", 40))
+	s.CompleteBundle(tokThree)
+	s.SetValidTokens(tokFive)
+	s.SetCache("t5", "s5", makeTestReusableInput("t5", "s5", 50))
+	s.Clear()
+
+	got := s.Metrics()
+	want := CacheMetrics{CapacityEvictions: 1, Expirations: 1, ManualInvalidations: 1, Flushes: 2, TotalEvictions: 5}
+	if got.CapacityEvictions != want.CapacityEvictions || got.Expirations != want.Expirations ||
+		got.ManualInvalidations != want.ManualInvalidations || got.Flushes != want.Flushes ||
+		got.TotalEvictions != want.TotalEvictions {
+		t.Errorf("eviction breakdown incorrect, expected %+v, got %+v", want, got)
+	}
+}
+
+func TestMetrics_Peak(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(100, sizeOfTestInput)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 40))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 50))
+	s.CompleteBundle(tokOne, tokTwo)
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	// Evicts both earlier inputs to make room.
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 70))
+
+	m := s.Metrics()
+	if m.BytesInUse != 70 || len(s.cache) != 1 {
+		t.Fatalf("cache contents incorrect, expected 1 entry of 70 bytes, got %v entries of %v bytes", len(s.cache), m.BytesInUse)
+	}
+	if m.PeakEntries != 2 {
+		t.Errorf("peak entries incorrect, expected 2, got %v", m.PeakEntries)
+	}
+	if m.PeakBytes != 90 {
+		t.Errorf("peak bytes incorrect, expected 90, got %v", m.PeakBytes)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+
+	s.Invalidate("t1", "s1")
+	if output, status := s.QueryCacheWithStatus("t1", "s1"); output != nil || status != MissInvalidToken {
+		t.Errorf("query after Invalidate incorrect, expected nil with %v, got %v with %v", MissInvalidToken, output, status)
+	}
+	if s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 11)) {
+		t.Errorf("TrySetCache cached input for invalidated IDs")
+	}
+	if output := s.QueryCache("t2", "s2"); output == nil {
+		t.Errorf("Invalidate dropped an unrelated input")
+	}
+	// Invalidating absent IDs is a no-op.
+	s.Invalidate("t3", "s3")
+	if s.metrics.ManualInvalidations != 1 {
+		t.Errorf("number of manual invalidations incorrect, expected 1, got %v", s.metrics.ManualInvalidations)
+	}
+
+	// Completing the bundle is unaffected, and the IDs become cacheable again
+	// once revalidated.
+	s.CompleteBundle(tokOne, tokTwo)
+	if len(s.validTokens) != 0 {
+		t.Errorf("valid tokens remaining after bundle completed, got %v", s.validTokens)
+	}
+	s.SetValidTokens(tokOne)
+	if !s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 12)) {
+		t.Errorf("TrySetCache did not cache input for revalidated IDs")
+	}
+}
+
+func TestMultimapCache(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetMultimapCache("t1", "s1", "k1", makeTestReusableInput("t1", "s1", 10))
+	s.SetMultimapCache("t1", "s1", "k2", makeTestReusableInput("t1", "s1", 20))
+	s.SetMultimapCache("t2", "s2", "k1", makeTestReusableInput("t2", "s2", 30))
+	if got := s.QueryMultimapCache("t1", "s1", "k1"); got == nil || got.Value() != 10 {
+		t.Errorf("multimap lookup for k1 incorrect, expected 10, got %v", got)
+	}
+	if got := s.QueryMultimapCache("t1", "s1", "k2"); got == nil || got.Value() != 20 {
+		t.Errorf("multimap lookup for k2 incorrect, expected 20, got %v", got)
+	}
+	if got := s.QueryMultimapCache("t1", "s1", "k3"); got != nil {
+		t.Errorf("multimap lookup for uncached key hit, got %v", got)
+	}
+	if got := s.QueryCache("t1", "s1"); got != nil {
+		t.Errorf("whole side input query hit a lookup key's entry, got %v", got)
+	}
+	want := []CacheKey{
+		{TransformID: "t1", SideInputID: "s1", LookupKey: "k1"},
+		{TransformID: "t1", SideInputID: "s1", LookupKey: "k2"},
+	}
+	if got := s.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("cached keys incorrect, expected %v, got %v", want, got)
+	}
+
+	// Completing the bundle makes every lookup key evictable.
+	s.CompleteBundle(tok)
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	for i, k := range []string{"k1", "k2", "k3"} {
+		s.SetMultimapCache("t2", "s2", k, makeTestReusableInput("t2", "s2", i))
+	}
+	if m := s.Metrics(); m.CapacityEvictions != 2 || m.InUseEvictions != 0 {
+		t.Errorf("eviction metrics incorrect, expected 2 capacity and 0 in use evictions, got %v and %v", m.CapacityEvictions, m.InUseEvictions)
+	}
+}
+
+func TestInvalidate_Multimap(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tok, tokTwo)
+	s.SetMultimapCache("t1", "s1", "k1", makeTestReusableInput("t1", "s1", 10))
+	s.SetMultimapCache("t1", "s1", "k2", makeTestReusableInput("t1", "s1", 20))
+	s.SetMultimapCache("t2", "s2", "k1", makeTestReusableInput("t2", "s2", 30))
+	s.Invalidate("t1", "s1")
+	if got := s.QueryMultimapCache("t1", "s1", "k1"); got != nil {
+		t.Errorf("multimap lookup hit after Invalidate, got %v", got)
+	}
+	want := []CacheKey{{TransformID: "t2", SideInputID: "s2", LookupKey: "k1"}}
+	if got := s.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("cached keys after Invalidate incorrect, expected %v, got %v", want, got)
+	}
+	if m := s.Metrics(); m.ManualInvalidations != 1 {
+		t.Errorf("number of manual invalidations incorrect, expected 1, got %v", m.ManualInvalidations)
+	}
+	// Lookup keys are cached again once a new token is validated.
+	s.SetValidTokens(makeRequest("t1", "s1", "tok3"))
+	s.SetMultimapCache("t1", "s1", "k1", makeTestReusableInput("t1", "s1", 40))
+	if got := s.QueryMultimapCache("t1", "s1", "k1"); got == nil || got.Value() != 40 {
+		t.Errorf("multimap lookup after revalidation incorrect, expected 40, got %v", got)
+	}
+}
+
+func TestSetEventLog(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	var buf bytes.Buffer
+	s.SetEventLog(&buf)
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.QueryCache("t1", "s1")
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.CompleteBundle(tokOne)
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.Clear()
+
+	want := []string{
+		`validate "t1" "s1" "tok1"`,
+		`miss "t1" "s1" "tok1"`,
+		`set "t1" "s1" "tok1"`,
+		`hit "t1" "s1" "tok1"`,
+		`validate "t2" "s2" "tok2"`,
+		`evict "t1" "s1" "tok1"`,
+		`set "t2" "s2" "tok2"`,
+		`flush "t2" "s2" "tok2"`,
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("event log incorrect, expected %v records, got %v", len(want), lines)
+	}
+	for i, line := range lines {
+		// Strip the timestamp.
+		if got := line[strings.Index(line, " ")+1:]; got != want[i] {
+			t.Errorf("event log record %v incorrect, expected %v, got %v", i, want[i], got)
+		}
+	}
+}
+
+func TestInit_Twice(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	// Reinitializing an empty cache is allowed.
+	if err := s.Init(2); err != nil {
+		t.Errorf("second init of empty cache failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if err := s.Init(2); !errors.Is(err, ErrAlreadyInitialized) {
+		t.Errorf("second init of populated cache error incorrect, expected ErrAlreadyInitialized, got %v", err)
+	}
+	if output := s.QueryCache("t1", "s1"); output == nil {
+		t.Errorf("failed init dropped a cached input")
+	}
+}
+
+func TestReinit(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if err := s.Reinit(0); err == nil {
+		t.Errorf("Reinit succeeded with zero capacity but should have failed")
+	}
+	if err := s.Reinit(2); err != nil {
+		t.Fatalf("Reinit failed, got %v", err)
+	}
+	if len(s.cache) != 0 || s.metrics.Flushes != 1 {
+		t.Errorf("Reinit did not clear the cache, got %v entries and %v flushes", len(s.cache), s.metrics.Flushes)
+	}
+
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect after Reinit, expected 2, got %v", len(s.cache))
+	}
+}
+
+func TestResize_Grow(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if err := s.Resize(2); err != nil {
+		t.Fatalf("Resize failed, got %v", err)
+	}
+	// Both are still in use, so this only fits after growing.
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if len(s.cache) != 2 {
+		t.Errorf("cache size incorrect, expected 2, got %v", len(s.cache))
+	}
+	if s.metrics.CapacityEvictions != 0 || s.metrics.InUseEvictions != 0 {
+		t.Errorf("growing evicted entries, got %+v", s.metrics)
+	}
+}
+
+func TestResize_Shrink(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo, tokThree)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	s.CompleteBundle(tokOne, tokTwo)
+
+	if err := s.Resize(1); err != nil {
+		t.Fatalf("Resize failed, got %v", err)
+	}
+	if len(s.cache) != 1 {
+		t.Errorf("cache size incorrect, expected 1, got %v", len(s.cache))
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t3", SideInputID: "s3"}]; !ok {
+		t.Errorf("in use entry was evicted by Resize")
+	}
+	if s.metrics.CapacityEvictions != 2 {
+		t.Errorf("number evictions incorrect, expected 2, got %v", s.metrics.CapacityEvictions)
+	}
+	if err := s.Resize(0); err == nil {
+		t.Errorf("Resize succeeded with zero capacity but should have failed")
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(5)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if got := (&SideInputCache{}).EvictionOrder(); got != nil {
+		t.Errorf("eviction order of uninitialized cache incorrect, expected nil, got %v", got)
+	}
+
+	var toks []fnpb.ProcessBundleRequest_CacheToken
+	for i := 1; i <= 5; i++ {
+		transID, sideID := fmt.Sprintf("t%d", i), fmt.Sprintf("s%d", i)
+		tok := makeRequest(transID, sideID, token(fmt.Sprintf("tok%d", i)))
+		toks = append(toks, tok)
+		s.SetValidTokens(tok)
+		s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, i))
+	}
+	// Make t1 the most recently used, pin t3, and leave t5 in use.
+	s.QueryCache("t1", "s1")
+	s.Pin("t3", "s3")
+	s.CompleteBundle(toks[:4]...)
+
+	want := []CacheKey{
+		{TransformID: "t2", SideInputID: "s2"},
+		{TransformID: "t4", SideInputID: "s4"},
+		{TransformID: "t1", SideInputID: "s1"},
+	}
+	if got := s.EvictionOrder(); !reflect.DeepEqual(got, want) {
+		t.Errorf("eviction order incorrect, expected %v, got %v", want, got)
+	}
+	// Listing the order neither evicts nor changes recency.
+	if got := s.EvictionOrder(); !reflect.DeepEqual(got, want) {
+		t.Errorf("eviction order changed by listing it, expected %v, got %v", want, got)
+	}
+	if len(s.cache) != 5 {
+		t.Errorf("entries evicted by listing the eviction order, cache size %v", len(s.cache))
+	}
+
+	// The first victim chosen to make room is the first key in the order.
+	s.SetValidTokens(makeRequest("t6", "s6", "tok6"))
+	s.SetCache("t6", "s6", makeTestReusableInput("t6", "s6", 6))
+	if _, ok := s.cache[want[0]]; ok {
+		t.Errorf("entry %v not evicted first", want[0])
+	}
+}
+
+func TestEvictFraction(t *testing.T) {
+	var s SideInputCache
+	var onPressure func()
+	err := s.Init(5, WithMemoryPressureHook(0.5, func(f func()) { onPressure = f }))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	var toks []fnpb.ProcessBundleRequest_CacheToken
+	for i := 1; i <= 5; i++ {
+		transID, sideID := fmt.Sprintf("t%d", i), fmt.Sprintf("s%d", i)
+		tok := makeRequest(transID, sideID, token(fmt.Sprintf("tok%d", i)))
+		toks = append(toks, tok)
+		s.SetValidTokens(tok)
+		s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, i))
+	}
+	// Leave the last entry in use, so four entries are evictable.
+	s.CompleteBundle(toks[:4]...)
+
+	tests := []struct {
+		fraction float64
+		want     int
+		left     int
+	}{
+		{fraction: 0, want: 0, left: 5},
+		{fraction: 0.5, want: 2, left: 3},
+		{fraction: 0.1, want: 1, left: 2},
+		{fraction: 2, want: 1, left: 1},
+		{fraction: 1, want: 0, left: 1},
+	}
+	for _, test := range tests {
+		if got := s.EvictFraction(test.fraction); got != test.want {
+			t.Errorf("EvictFraction(%v) incorrect, expected %v, got %v", test.fraction, test.want, got)
+		}
+		if len(s.cache) != test.left {
+			t.Errorf("cache size after EvictFraction(%v) incorrect, expected %v, got %v", test.fraction, test.left, len(s.cache))
+		}
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t5", SideInputID: "s5"}]; !ok {
+		t.Errorf("in use entry was evicted by EvictFraction")
+	}
+	if s.metrics.PressureEvictions != 4 {
+		t.Errorf("number pressure evictions incorrect, expected 4, got %v", s.metrics.PressureEvictions)
+	}
+
+	s.CompleteBundle(toks[4])
+	onPressure()
+	if len(s.cache) != 0 {
+		t.Errorf("cache size after memory pressure incorrect, expected 0, got %v", len(s.cache))
+	}
+}
+
+func TestWithNamespace(t *testing.T) {
+	// The caches share a secondary, so only the namespace keeps their side inputs apart.
+	secondary := &fakeSecondary{}
+	var one, two SideInputCache
+	if err := one.Init(1, WithNamespace("job1"), WithSecondary(secondary)); err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if err := two.Init(1, WithNamespace("job2"), WithSecondary(secondary)); err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	inOne := makeTestReusableInput("t1", "s1", 10)
+	inTwo := makeTestReusableInput("t1", "s1", 20)
+	for _, c := range []struct {
+		s  *SideInputCache
+		in ReusableInput
+	}{{&one, inOne}, {&two, inTwo}} {
+		c.s.SetValidTokens(tok)
+		c.s.SetCache("t1", "s1", c.in)
+		c.s.CompleteBundle(tok)
+		// Spill the input to the secondary.
+		other := makeRequest("t2", "s2", "tok2")
+		c.s.SetValidTokens(other)
+		c.s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 30))
+		c.s.CompleteBundle(other)
+	}
+
+	one.SetValidTokens(tok)
+	two.SetValidTokens(tok)
+	if output := one.QueryCache("t1", "s1"); output != inOne {
+		t.Errorf("QueryCache of first namespace incorrect, expected %v, got %v", inOne, output)
+	}
+	if output := two.QueryCache("t1", "s1"); output != inTwo {
+		t.Errorf("QueryCache of second namespace incorrect, expected %v, got %v", inTwo, output)
+	}
+	want := []CacheKey{{Namespace: "job1", TransformID: "t1", SideInputID: "s1"}}
+	if keys := one.Keys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys incorrect, expected %v, got %v", want, keys)
+	}
+}
+
+func TestKeyStats(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	for i := 0; i < 5; i++ {
+		s.QueryCache("t1", "s1")
+	}
+	s.QueryCache("t2", "s2")
+	want := map[CacheKey]int{
+		{TransformID: "t1", SideInputID: "s1"}: 5,
+		{TransformID: "t2", SideInputID: "s2"}: 1,
+	}
+	if got := s.KeyStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyStats incorrect, expected %v, got %v", want, got)
+	}
+
+	// Evicting t1 and caching it again restarts its count.
+	s.CompleteBundle(tokOne, tokTwo)
+	s.SetValidTokens(makeRequest("t3", "s3", "tok3"))
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	s.SetValidTokens(makeRequest("t1", "s1", "tok4"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 40))
+	s.QueryCache("t1", "s1")
+	want = map[CacheKey]int{
+		{TransformID: "t1", SideInputID: "s1"}: 1,
+		{TransformID: "t3", SideInputID: "s3"}: 0,
+	}
+	if got := s.KeyStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("KeyStats after eviction incorrect, expected %v, got %v", want, got)
+	}
+}
+
+func TestLastAccess(t *testing.T) {
+	var s SideInputCache
+	clk := &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := s.Init(2, WithClock(clk))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	if _, ok := s.LastAccess("t1", "s1"); ok {
+		t.Errorf("LastAccess found an uncached input")
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t2", "s2", "tok2"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if _, ok := s.LastAccess("t1", "s1"); ok {
+		t.Errorf("LastAccess found an input never hit")
+	}
+	for i := 0; i < 3; i++ {
+		clk.advance(time.Minute)
+		s.QueryCache("t1", "s1")
+		if got, ok := s.LastAccess("t1", "s1"); !ok || !got.Equal(clk.now) {
+			t.Errorf("LastAccess after hit %v incorrect, expected %v, got %v and %v", i, clk.now, got, ok)
+		}
+	}
+
+	// LastAccess leaves t1 least recently used.
+	s.QueryCache("t2", "s2")
+	s.LastAccess("t1", "s1")
+	if key, _ := s.policy.Victim(func(CacheKey) bool { return true }); key.TransformID != "t1" {
+		t.Errorf("LastAccess updated recency, expected victim t1, got %v", key)
+	}
+}
+
+func TestLenAndCap(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if s.Len() != 0 || s.Cap() != 2 {
+		t.Errorf("Len and Cap of empty cache incorrect, expected 0 and 2, got %v and %v", s.Len(), s.Cap())
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if s.Len() != 1 {
+		t.Errorf("Len incorrect, expected 1, got %v", s.Len())
+	}
+	s.CompleteBundle(tokOne)
+	if err := s.Resize(1); err != nil {
+		t.Fatalf("Resize failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t2", "s2", "tok2"))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	if s.Len() != 1 || s.Cap() != 1 {
+		t.Errorf("Len and Cap after Resize incorrect, expected 1 and 1, got %v and %v", s.Len(), s.Cap())
+	}
+
+	var b SideInputCache
+	if err := b.InitWithByteLimit(100, func(ReusableInput) int64 { return 1 }); err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if b.Cap() != 0 {
+		t.Errorf("Cap of cache bounded by bytes incorrect, expected 0, got %v", b.Cap())
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(4)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if got := s.Utilization(); got != 0 {
+		t.Errorf("Utilization of empty cache incorrect, expected 0, got %v", got)
+	}
+
+	for i := 1; i <= 4; i++ {
+		transID, sideID := fmt.Sprintf("t%d", i), fmt.Sprintf("s%d", i)
+		s.SetValidTokens(makeRequest(transID, sideID, token(fmt.Sprintf("tok%d", i))))
+		s.SetCache(transID, sideID, makeTestReusableInput(transID, sideID, i))
+		if got, want := s.Utilization(), float64(i)/4; got != want {
+			t.Errorf("Utilization after %v entries incorrect, expected %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestUtilization_ByteLimit(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(100, func(in ReusableInput) int64 { return 25 })
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if got := s.Utilization(); got != 0.25 {
+		t.Errorf("Utilization incorrect, expected 0.25, got %v", got)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	if keys := s.Keys(); len(keys) != 0 {
+		t.Errorf("keys of empty cache incorrect, expected none, got %v", keys)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	if got, want := s.Keys(), []CacheKey{{TransformID: "t1", SideInputID: "s1"}, {TransformID: "t2", SideInputID: "s2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys incorrect, expected %v, got %v", want, got)
+	}
+	// t2 is the least recently used, and listing keys must not change that.
+	s.CompleteBundle(tokOne, tokTwo)
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokThree)
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	if got, want := s.Keys(), []CacheKey{{TransformID: "t1", SideInputID: "s1"}, {TransformID: "t3", SideInputID: "s3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys incorrect after eviction, expected %v, got %v", want, got)
+	}
+}
+
+func TestTrySetCache_AfterCompleteBundle(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.CompleteBundle(tok)
+	// A late set from the finished bundle must not cache a value that would never be refreshed.
+	if s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10)) {
+		t.Errorf("TrySetCache cached an input under a completed token")
+	}
+	if len(s.cache) != 0 {
+		t.Errorf("cache size incorrect, expected 0, got %v", len(s.cache))
+	}
+}
+
+func TestTrySetCache_Oversized(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(50, sizeOfTestInput)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 20))
+	s.CompleteBundle(tokOne)
+
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	if s.TrySetCache("t2", "s2", makeTestReusableInput("t2", "s2", 60)) {
+		t.Errorf("TrySetCache cached an input larger than the byte limit")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("oversized input evicted existing entries")
+	}
+	if s.metrics.OversizedRejections != 1 {
+		t.Errorf("number of oversized rejections incorrect, expected 1, got %v", s.metrics.OversizedRejections)
+	}
+	if s.metrics.CapacityEvictions != 0 {
+		t.Errorf("number evictions incorrect, expected 0, got %v", s.metrics.CapacityEvictions)
+	}
+}
+
+func TestTrySetCache_ReplaceWithoutRoom(t *testing.T) {
+	var s SideInputCache
+	err := s.InitWithByteLimit(10, sizeOfTestInput)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 5))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 4))
+	if s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 7)) {
+		t.Errorf("TrySetCache cached a replacement that does not fit")
+	}
+	if got, status := s.QueryCacheWithStatus("t1", "s1"); status != Hit || got.Value() != 5 {
+		t.Errorf("replaced input incorrect after failed replacement, expected 5 and %v, got %v and %v", Hit, got, status)
+	}
+	// The room taken by the replaced input is reused.
+	if !s.TrySetCache("t1", "s1", makeTestReusableInput("t1", "s1", 6)) {
+		t.Errorf("TrySetCache did not cache a replacement fitting in the room of the replaced input")
+	}
+	if got := s.QueryCache("t1", "s1"); got == nil || got.Value() != 6 {
+		t.Errorf("replacement input incorrect, expected 6, got %v", got)
+	}
+	if m := s.Metrics(); m.BytesInUse != 10 || m.CapacityEvictions != 0 {
+		t.Errorf("metrics after replacement incorrect, expected 10 bytes in use and 0 evictions, got %v and %v", m.BytesInUse, m.CapacityEvictions)
+	}
+}
+
+func TestSetCacheWeighted_ReplaceWithoutRoom(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.SetCacheWeighted("t1", "s1", makeTestReusableInput("t1", "s1", 30), 2)
+	if got := s.QueryCache("t1", "s1"); got == nil || got.Value() != 10 {
+		t.Errorf("replaced input incorrect after failed replacement, expected 10, got %v", got)
+	}
+	s.SetCacheBatch([]CacheEntry{{TransformID: "t2", SideInputID: "s2", Input: makeTestReusableInput("t2", "s2", 40)}})
+	if got := s.QueryCache("t2", "s2"); got == nil || got.Value() != 40 {
+		t.Errorf("batch replacement of an input in a full cache incorrect, expected 40, got %v", got)
+	}
+	if m := s.Metrics(); m.InUseEvictions != 1 || m.CapacityEvictions != 0 {
+		t.Errorf("eviction metrics incorrect, expected 1 in use and 0 capacity evictions, got %v and %v", m.InUseEvictions, m.CapacityEvictions)
+	}
+}
+
+func TestCacheKey_NoCollision(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	// Both pairs concatenate to "abc".
+	tokOne := makeRequest("ab", "c", "tok1")
+	tokTwo := makeRequest("a", "bc", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("ab", "c", makeTestReusableInput("ab", "c", 10))
+	s.SetCache("a", "bc", makeTestReusableInput("a", "bc", 20))
+
+	if len(s.idsToTokens) != 2 {
+		t.Errorf("token mappings collided, got %v", s.idsToTokens)
+	}
+	for _, test := range []struct {
+		transformID, sideInputID string
+		want                     int
+	}{
+		{"ab", "c", 10},
+		{"a", "bc", 20},
+	} {
+		output := s.QueryCache(test.transformID, test.sideInputID)
+		if output == nil {
+			t.Fatalf("call to query cache for (%v, %v) missed when should have hit", test.transformID, test.sideInputID)
+		}
+		if val := output.Value().(int); val != test.want {
+			t.Errorf("element mismatch for (%v, %v), expected %v, got %v", test.transformID, test.sideInputID, test.want, val)
+		}
+	}
+}
+
+func TestQueryCacheContext(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+
+	output, err := s.QueryCacheContext(context.Background(), "t1", "s1")
+	if err != nil || output == nil {
+		t.Errorf("QueryCacheContext incorrect, expected a hit, got %v with error %v", output, err)
+	}
+	output, err = s.QueryCacheContext(context.Background(), "t2", "s2")
+	if err != nil || output != nil {
+		t.Errorf("QueryCacheContext incorrect, expected a miss, got %v with error %v", output, err)
+	}
+
+	// A done context returns without querying the cache.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := s.Metrics()
+	if _, err := s.QueryCacheContext(cancelled, "t1", "s1"); err != context.Canceled {
+		t.Errorf("QueryCacheContext error incorrect, expected %v, got %v", context.Canceled, err)
+	}
+	if m := s.Metrics(); m.Hits != before.Hits || m.Misses != before.Misses {
+		t.Errorf("QueryCacheContext with a done context queried the cache, hits and misses went from %v and %v to %v and %v", before.Hits, before.Misses, m.Hits, m.Misses)
+	}
+}
+
+func TestWithFreeNegativeEntries(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2, WithFreeNegativeEntries(3))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.CompleteBundle(tokOne, tokTwo)
+
+	// Flood the cache with side inputs known to be empty.
+	for i := 0; i < 10; i++ {
+		side := fmt.Sprintf("e%d", i)
+		tok := makeRequest("t3", side, token(side))
+		s.SetValidTokens(tok)
+		s.SetCacheEmpty("t3", side)
+		if _, status := s.QueryCacheWithStatus("t3", side); status != HitEmpty {
+			t.Errorf("query of empty side input %v incorrect, expected %v, got %v", side, HitEmpty, status)
+		}
+		s.CompleteBundle(tok)
+	}
+	for _, key := range []CacheKey{{TransformID: "t1", SideInputID: "s1"}, {TransformID: "t2", SideInputID: "s2"}} {
+		if _, ok := s.cache[key]; !ok {
+			t.Errorf("cached input %v displaced by empty entries", key)
+		}
+	}
+	if s.negatives != 3 || len(s.cache) != 5 {
+		t.Errorf("number of empty entries incorrect, expected 3 beside 2 inputs, got %v of %v entries", s.negatives, len(s.cache))
+	}
+	if got := s.Utilization(); got != 1 {
+		t.Errorf("utilization incorrect, expected only the inputs to count, got %v", got)
+	}
+
+	// Every empty entry in use leaves no room for another.
+	var toks []fnpb.ProcessBundleRequest_CacheToken
+	for i := 7; i < 10; i++ {
+		side := fmt.Sprintf("e%d", i)
+		toks = append(toks, makeRequest("t3", side, token(side)))
+	}
+	toks = append(toks, makeRequest("t4", "s4", "tok4"))
+	s.SetValidTokens(toks...)
+	s.SetCacheEmpty("t4", "s4")
+	if _, ok := s.cache[CacheKey{TransformID: "t4", SideInputID: "s4"}]; ok {
+		t.Errorf("empty entry cached though every empty entry is in use")
+	}
+}
+
+func TestSetCacheEmpty(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	// Uncacheable, so nothing is recorded.
+	s.SetCacheEmpty("t1", "s1")
+	if len(s.cache) != 0 {
+		t.Errorf("empty entry cached for invalid token")
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCacheEmpty("t1", "s1")
+	if output, status := s.QueryCacheWithStatus("t1", "s1"); output != nil || status != HitEmpty {
+		t.Errorf("query of empty entry incorrect, expected nil with %v, got %v with %v", HitEmpty, output, status)
+	}
+
+	// The empty entry takes up capacity and is evictable once its token is invalid.
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokTwo)
+	if s.TrySetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20)) {
+		t.Errorf("TrySetCache evicted an empty entry with a valid token")
+	}
+	s.CompleteBundle(tokOne)
+	if _, status := s.QueryCacheWithStatus("t1", "s1"); status != MissInvalidToken {
+		t.Errorf("query of empty entry with completed token incorrect, expected %v, got %v", MissInvalidToken, status)
+	}
+	if !s.TrySetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20)) {
+		t.Errorf("TrySetCache failed to evict an empty entry with an invalid token")
+	}
+}
+
+func TestTokenRefCounts(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithStuckTokenAge(time.Hour))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetValidTokens(tokOne)
+	// Pretend the first token became valid long ago.
+	s.validSince["tok1"] = time.Now().Add(-2 * time.Hour)
+
+	counts := s.TokenRefCounts()
+	if len(counts) != 2 {
+		t.Fatalf("number of token ref counts incorrect, expected 2, got %v", counts)
+	}
+	if string(counts[0].Token) != "tok1" || counts[0].Count != 2 {
+		t.Errorf("first token ref count incorrect, expected tok1 with 2, got %s with %v", counts[0].Token, counts[0].Count)
+	}
+	if string(counts[1].Token) != "tok2" || counts[1].Count != 1 {
+		t.Errorf("second token ref count incorrect, expected tok2 with 1, got %s with %v", counts[1].Token, counts[1].Count)
+	}
+	if m := s.Metrics(); m.StuckTokens != 1 {
+		t.Errorf("number of stuck tokens incorrect, expected 1, got %v", m.StuckTokens)
+	}
+
+	s.CompleteBundle(tokOne)
+	s.CompleteBundle(tokOne)
+	if m := s.Metrics(); m.StuckTokens != 0 {
+		t.Errorf("number of stuck tokens incorrect after completion, expected 0, got %v", m.StuckTokens)
+	}
+}
+
+func TestCompleteBundles(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	tokThree := makeRequest("t3", "s3", "tok3")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetValidTokens(tokTwo, tokThree)
+	s.CompleteBundles(tokOne, tokTwo, tokTwo, tokThree)
+	for _, tok := range []token{"tok1", "tok2", "tok3"} {
+		if count := s.validTokens[tok]; count != 0 {
+			t.Errorf("token count for %v incorrect, expected 0, got %v", tok, count)
+		}
+	}
+	if m := s.Metrics(); m.CompleteBundles != 4 || m.UnbalancedCompletions != 0 {
+		t.Errorf("completion metrics incorrect, expected 4 completed and 0 unbalanced, got %v and %v", m.CompleteBundles, m.UnbalancedCompletions)
+	}
+}
+
+func TestResetForNewBundle(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	// A bundle crashes without completing, leaking its tokens.
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetValidTokens(tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+
+	tokThree := makeRequest("t3", "s3", "tok3")
+	if n := s.ResetForNewBundle(tokTwo, tokThree); n != 2 {
+		t.Errorf("number of reaped tokens incorrect, expected 2, got %v", n)
+	}
+	if s.IsValidToken(tokOne.GetToken()) {
+		t.Errorf("leaked token still valid after ResetForNewBundle")
+	}
+	if count := s.validTokens["tok2"]; count != 1 {
+		t.Errorf("token count for revalidated token incorrect, expected 1, got %v", count)
+	}
+	if !s.IsValidToken(tokThree.GetToken()) {
+		t.Errorf("new token invalid after ResetForNewBundle")
+	}
+	// The leaked entry can now make room for the new bundle's input.
+	s.SetCache("t3", "s3", makeTestReusableInput("t3", "s3", 30))
+	if got := s.QueryCache("t3", "s3"); got == nil {
+		t.Errorf("input for new token not cached after ResetForNewBundle")
+	}
+	if got := s.QueryCache("t2", "s2"); got == nil || got.Value() != 20 {
+		t.Errorf("input for revalidated token incorrect, expected 20, got %v", got)
+	}
+	if m := s.Metrics(); m.InUseEvictions != 0 || m.CapacityEvictions != 1 {
+		t.Errorf("eviction metrics incorrect, expected 0 in use and 1 capacity evictions, got %v and %v", m.InUseEvictions, m.CapacityEvictions)
+	}
+
+	s.CompleteBundle(tokTwo, tokThree)
+	if len(s.validTokens) != 0 || len(s.idsToTokens) != 0 {
+		t.Errorf("tokens remaining after the new bundle completed, got %v", s.validTokens)
+	}
+}
+
+func TestResetForNewBundle_StrictMode(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2, WithStrictMode())
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetValidTokens(tokOne)
+	expectPanic(t, `token "tok1" is held by 2 bundles`, func() { s.ResetForNewBundle() })
+	if count := s.validTokens["tok1"]; count != 2 {
+		t.Errorf("token count after panic incorrect, expected 2, got %v", count)
+	}
+
+	// A single crashed bundle's tokens are released.
+	s.CompleteBundle(tokOne)
+	if n := s.ResetForNewBundle(); n != 1 {
+		t.Errorf("number of reaped tokens incorrect, expected 1, got %v", n)
+	}
+}
+
+func TestCompleteBundle_Unbalanced(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.CompleteBundle(tok)
+	s.CompleteBundle(tok)
+	if count := s.validTokens["tok1"]; count != 0 {
+		t.Errorf("token count incorrect, expected 0, got %v", count)
+	}
+	if m := s.Metrics(); m.UnbalancedCompletions != 1 {
+		t.Errorf("number of unbalanced completions incorrect, expected 1, got %v", m.UnbalancedCompletions)
+	}
+
+	// The token is still usable by a later bundle.
+	s.SetValidTokens(tok)
+	if !s.IsValidToken(tok.GetToken()) {
+		t.Errorf("token invalid after SetValidTokens")
+	}
+}
+
+func TestSetValidTokens_MutatedBytes(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	// The caller reuses the token's backing array for another request.
+	copy(tok.Token, "tokX")
+	if !s.isValid("tok1") {
+		t.Errorf("token invalid after its source bytes were mutated")
+	}
+	if s.isValid("tokX") {
+		t.Errorf("mutated token bytes became valid")
+	}
+	if got := s.QueryCache("t1", "s1"); got == nil || got.Value() != 10 {
+		t.Errorf("query after source bytes were mutated incorrect, expected 10, got %v", got)
+	}
+	s.CompleteBundle(makeRequest("t1", "s1", "tok1"))
+	if len(s.validTokens) != 0 {
+		t.Errorf("tokens remaining after bundle completed, got %v", s.validTokens)
+	}
+}
+
+func TestIsValidToken(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tok := makeRequest("t1", "s1", "tok1")
+	if s.IsValidToken(tok.GetToken()) {
+		t.Errorf("token valid before SetValidTokens")
+	}
+	s.SetValidTokens(tok)
+	if !s.IsValidToken(tok.GetToken()) {
+		t.Errorf("token invalid after SetValidTokens")
+	}
+	s.CompleteBundle(tok)
+	if s.IsValidToken(tok.GetToken()) {
+		t.Errorf("token valid after CompleteBundle")
+	}
+}
+
+func TestSetValidTokens_RetainedAcrossBundles(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	in := makeTestReusableInput("t1", "s1", 10)
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", in)
+	// A second bundle validating the same token overlaps the first.
+	s.SetValidTokens(tok)
+	if got := s.validTokens["tok1"]; got != 2 {
+		t.Errorf("token count incorrect, expected 2, got %v", got)
+	}
+	s.CompleteBundle(tok)
+	if output := s.QueryCache("t1", "s1"); output != in {
+		t.Errorf("QueryCache in overlapping bundle incorrect, expected %v, got %v", in, output)
+	}
+	s.CompleteBundle(tok)
+
+	// A later bundle with the same token finds the input without refetching it.
+	s.SetValidTokens(tok)
+	if output := s.QueryCache("t1", "s1"); output != in {
+		t.Errorf("QueryCache in later bundle incorrect, expected %v, got %v", in, output)
+	}
+	if s.metrics.Misses != 0 {
+		t.Errorf("number of misses incorrect, expected 0, got %v", s.metrics.Misses)
+	}
+}
+
+func TestWithTokenComparator(t *testing.T) {
+	// Tokens are equivalent regardless of their version prefix.
+	unversioned := func(tok []byte) []byte {
+		if i := bytes.IndexByte(tok, ':'); i >= 0 {
+			return tok[i+1:]
+		}
+		return tok
+	}
+	var s SideInputCache
+	err := s.Init(1, WithTokenComparator(func(a, b []byte) bool {
+		return bytes.Equal(unversioned(a), unversioned(b))
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	in := makeTestReusableInput("t1", "s1", 10)
+	tokOne := makeRequest("t1", "s1", "v1:tok")
+	tokTwo := makeRequest("t1", "s1", "v2:tok")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", in)
+	s.SetValidTokens(tokTwo)
+	if got := s.validTokens["v1:tok"]; got != 2 {
+		t.Errorf("count of equivalent tokens incorrect, expected 2, got %v", got)
+	}
+	if output := s.QueryCache("t1", "s1"); output != in {
+		t.Errorf("QueryCache under equivalent token incorrect, expected %v, got %v", in, output)
+	}
+	s.CompleteBundle(tokTwo)
+	if !s.IsValidToken([]byte("v2:tok")) {
+		t.Errorf("equivalent token invalid while a bundle using it is active")
+	}
+	s.CompleteBundle(tokOne)
+	if s.IsValidToken([]byte("v1:tok")) {
+		t.Errorf("token still valid after every bundle completed")
+	}
+
+	// A later bundle with an equivalent token finds the cached input.
+	s.SetValidTokens(makeRequest("t1", "s1", "v3:tok"))
+	if output := s.QueryCache("t1", "s1"); output != in {
+		t.Errorf("QueryCache in later bundle incorrect, expected %v, got %v", in, output)
+	}
+
+	// Tokens that are not equivalent still miss.
+	s.SetValidTokens(makeRequest("t1", "s1", "v1:other"))
+	if output := s.QueryCache("t1", "s1"); output != nil {
+		t.Errorf("QueryCache under a different token hit, got %v", output)
+	}
+}
+
+func TestSetValidTokens_SharedToken(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t1", "s2", "tok1")
+	s.SetValidTokens(tokOne, tokTwo)
+	if got := s.validTokens["tok1"]; got != 1 {
+		t.Errorf("token count incorrect, expected 1, got %v", got)
+	}
+	for _, key := range []CacheKey{{TransformID: "t1", SideInputID: "s1"}, {TransformID: "t1", SideInputID: "s2"}} {
+		if got := s.idsToTokens[key]; got != "tok1" {
+			t.Errorf("token for %v incorrect, expected tok1, got %v", key, got)
+		}
+	}
+
+	s.CompleteBundle(tokOne, tokTwo)
+	if _, ok := s.validTokens["tok1"]; ok {
+		t.Errorf("token tok1 still valid after completing its only bundle")
+	}
+}
+
+func TestCompleteBundle_SharedTokenFanOut(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	shared := []fnpb.ProcessBundleRequest_CacheToken{
+		makeRequest("t1", "s1", "tok1"),
+		makeRequest("t1", "s2", "tok1"),
+		makeRequest("t2", "s3", "tok1"),
+	}
+	s.SetValidTokens(shared...)
+	for _, tok := range shared {
+		side := tok.GetSideInput()
+		s.SetCache(side.GetTransformId(), side.GetSideInputId(), makeTestReusableInput(side.GetTransformId(), side.GetSideInputId(), 10))
+	}
+	want := []CacheKey{
+		{TransformID: "t1", SideInputID: "s1"},
+		{TransformID: "t1", SideInputID: "s2"},
+		{TransformID: "t2", SideInputID: "s3"},
+	}
+	if got := s.TokenKeys([]byte("tok1")); !reflect.DeepEqual(got, want) {
+		t.Errorf("TokenKeys returned incorrect keys, expected %v, got %v", want, got)
+	}
+
+	s.CompleteBundle(shared...)
+	if len(s.validTokens) != 0 {
+		t.Errorf("shared token still valid after CompleteBundle, got %v", s.validTokens)
+	}
+	if got := s.TokenKeys([]byte("tok1")); len(got) != 0 {
+		t.Errorf("TokenKeys returned keys for completed token, got %v", got)
+	}
+	if len(s.idsToTokens) != 0 {
+		t.Errorf("keys still mapped to completed token, got %v", s.idsToTokens)
+	}
+
+	// Every entry of the shared token is now evictable.
+	s.SetValidTokens(makeRequest("t3", "s1", "tok2"), makeRequest("t3", "s2", "tok2"), makeRequest("t3", "s3", "tok2"))
+	for _, id := range []string{"s1", "s2", "s3"} {
+		s.SetCache("t3", id, makeTestReusableInput("t3", id, 20))
+	}
+	if s.metrics.CapacityEvictions != 3 {
+		t.Errorf("number of evictions incorrect, expected 3, got %v", s.metrics.CapacityEvictions)
+	}
+	if s.metrics.InUseEvictions != 0 {
+		t.Errorf("number of in use evictions incorrect, expected 0, got %v", s.metrics.InUseEvictions)
+	}
+}
+
+func TestSetValidTokens_MixedTypes(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	userState := makeUserStateRequest("tok2")
+	var untyped fnpb.ProcessBundleRequest_CacheToken
+	untyped.Token = []byte("tok3")
+	side := makeRequest("t1", "s1", "tok1")
+
+	if got := s.SetValidTokens(userState, side, untyped); got != 2 {
+		t.Errorf("number of applied tokens incorrect, expected 2, got %v", got)
+	}
+	if len(s.idsToTokens) != 1 {
+		t.Errorf("number of mapped IDs incorrect, expected 1, got %v", s.idsToTokens)
+	}
+	if got := s.idsToTokens[CacheKey{TransformID: "t1", SideInputID: "s1"}]; got != "tok1" {
+		t.Errorf("token for side input incorrect, expected tok1, got %v", got)
+	}
+	if len(s.validTokens) != 2 {
+		t.Errorf("number of valid tokens incorrect, expected 2, got %v", s.validTokens)
+	}
+
+	s.CompleteBundle(userState, side, untyped)
+	if len(s.validTokens) != 0 {
+		t.Errorf("valid tokens remain after CompleteBundle, got %v", s.validTokens)
+	}
+}
+
+func TestBundleStats(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t2", "s2", "tok2")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.QueryCache("t1", "s1")
+	s.CompleteBundle(tokOne)
+
+	s.SetValidTokens(tokTwo)
+	s.QueryCache("t2", "s2")
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.QueryCache("t2", "s2")
+
+	if got, want := s.BundleStats([]byte("tok2")), (BundleCacheStats{Hits: 1, Misses: 1, Evictions: 1, PeakBundles: 1}); got != want {
+		t.Errorf("bundle stats incorrect, expected %+v, got %+v", want, got)
+	}
+	if got := s.BundleStats([]byte("tok1")); got != (BundleCacheStats{}) {
+		t.Errorf("bundle stats of completed token incorrect, expected zero, got %+v", got)
+	}
+	if got := s.Metrics().Hits; got != 3 {
+		t.Errorf("number of hits incorrect, expected 3, got %v", got)
+	}
+
+	s.CompleteBundle(tokTwo)
+	if got := s.BundleStats([]byte("tok2")); got != (BundleCacheStats{}) {
+		t.Errorf("bundle stats after completion incorrect, expected zero, got %+v", got)
+	}
+}
+
+func makeUserStateRequest(t token) fnpb.ProcessBundleRequest_CacheToken {
+	var tok fnpb.ProcessBundleRequest_CacheToken
+	tok.Type = &fnpb.ProcessBundleRequest_CacheToken_UserState_{
+		UserState: &fnpb.ProcessBundleRequest_CacheToken_UserState{},
+	}
+	tok.Token = []byte(t)
+	return tok
+}
+
+func TestUserStateCache(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(2)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	state := makeTestReusableInput("t1", "u1", 10)
+	s.SetUserStateCache("t1", "u1", state)
+	if got := s.QueryUserState("t1", "u1"); got != nil {
+		t.Errorf("user state cached without a valid token, got %v", got)
+	}
+
+	stateTok := makeUserStateRequest("tok1")
+	sideTok := makeRequest("t1", "u1", "tok2")
+	s.SetValidTokens(stateTok, sideTok)
+	s.SetUserStateCache("t1", "u1", state)
+	side := makeTestReusableInput("t1", "u1", 20)
+	s.SetCache("t1", "u1", side)
+	if got := s.QueryUserState("t1", "u1"); got != state {
+		t.Errorf("QueryUserState returned incorrect input, expected %v, got %v", state, got)
+	}
+	if got := s.QueryCache("t1", "u1"); got != side {
+		t.Errorf("QueryCache returned incorrect input, expected %v, got %v", side, got)
+	}
+
+	s.CompleteBundle(stateTok, sideTok)
+	if got := s.QueryUserState("t1", "u1"); got != nil {
+		t.Errorf("user state returned after its token was completed, got %v", got)
+	}
+
+	// Both entries are now invalid, so a new bundle's user state evicts one of them.
+	s.SetValidTokens(makeUserStateRequest("tok3"))
+	s.SetUserStateCache("t2", "u2", state)
+	if got := s.QueryUserState("t2", "u2"); got != state {
+		t.Errorf("QueryUserState returned incorrect input, expected %v, got %v", state, got)
+	}
+	if got := s.metrics.CapacityEvictions; got != 1 {
+		t.Errorf("number of evictions incorrect, expected 1, got %v", got)
+	}
+}
+
+func makeBenchmarkTokens(n int) []fnpb.ProcessBundleRequest_CacheToken {
+	tokens := make([]fnpb.ProcessBundleRequest_CacheToken, n)
+	for i := range tokens {
+		id := fmt.Sprintf("%03d", i)
+		tokens[i] = makeRequest("t"+id, "s"+id, token("tok"+id))
+	}
+	return tokens
+}
+
+// BenchmarkSetValidTokens measures validating the tokens of a bundle with many side
+// inputs on a freshly initialized cache.
+func BenchmarkSetValidTokens(b *testing.B) {
+	tokens := makeBenchmarkTokens(500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var s SideInputCache
+		if err := s.Init(500); err != nil {
+			b.Fatalf("cache init failed, got %v", err)
+		}
+		b.StartTimer()
+		s.SetValidTokens(tokens...)
+	}
+}
+
+func BenchmarkSetCache_EvictionBatch(b *testing.B) {
+	const n = 512
+	tokens := makeBenchmarkTokens(n)
+	input := makeTestReusableInput("t", "s", 1)
+	for _, batch := range []int{1, 16} {
+		b.Run(fmt.Sprintf("batch%d", batch), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var s SideInputCache
+				if err := s.Init(n/4, WithEvictionBatch(batch)); err != nil {
+					b.Fatalf("cache init failed, got %v", err)
+				}
+				b.StartTimer()
+				for _, tok := range tokens {
+					side := tok.GetSideInput()
+					s.SetValidTokens(tok)
+					s.SetCache(side.GetTransformId(), side.GetSideInputId(), input)
+					s.CompleteBundle(tok)
+				}
+			}
+		})
+	}
+}
+
+// swapCache is a minimal copy-on-write map whose reads take no lock, used as a
+// baseline for the read path of SideInputCache in BenchmarkQueryCache_ReadHeavy.
+type swapCache struct {
+	mu sync.Mutex // Serializes writers.
+	m  atomic.Value
+}
+
+func (c *swapCache) query(key CacheKey) ReusableInput {
+	m, _ := c.m.Load().(map[CacheKey]ReusableInput)
+	return m[key]
+}
+
+func (c *swapCache) set(key CacheKey, input ReusableInput) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, _ := c.m.Load().(map[CacheKey]ReusableInput)
+	m := make(map[CacheKey]ReusableInput, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	m[key] = input
+	c.m.Store(m)
+}
+
+// BenchmarkQueryCache_ReadHeavy compares SideInputCache against a lock-free
+// copy-on-write map under a parallel workload of 95% queries and 5% sets. Every
+// set copies the whole map, which outweighs the lock-free reads at this write
+// rate, and queries also update the eviction policy and metrics, which a map
+// swapped only on writes cannot do.
+func BenchmarkQueryCache_ReadHeavy(b *testing.B) {
+	const n = 100
+	tokens := makeBenchmarkTokens(n)
+	keys := make([]CacheKey, n)
+	for i, tok := range tokens {
+		side := tok.GetSideInput()
+		keys[i] = CacheKey{TransformID: side.GetTransformId(), SideInputID: side.GetSideInputId()}
+	}
+	input := makeTestReusableInput("t", "s", 1)
+
+	b.Run("mutex", func(b *testing.B) {
+		var s SideInputCache
+		if err := s.Init(n); err != nil {
+			b.Fatalf("cache init failed, got %v", err)
+		}
+		s.SetValidTokens(tokens...)
+		for _, key := range keys {
+			s.SetCache(key.TransformID, key.SideInputID, input)
+		}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				key := keys[i%n]
+				if i%20 == 0 {
+					s.SetCache(key.TransformID, key.SideInputID, input)
+				} else {
+					s.QueryCache(key.TransformID, key.SideInputID)
+				}
+			}
+		})
+	})
+	b.Run("atomicSwap", func(b *testing.B) {
+		var s swapCache
+		for _, key := range keys {
+			s.set(key, input)
+		}
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				key := keys[i%n]
+				if i%20 == 0 {
+					s.set(key, input)
+				} else {
+					s.query(key)
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkSingleSideInputBundle measures processing bundles using a single cached side input.
+func BenchmarkSingleSideInputBundle(b *testing.B) {
+	var s SideInputCache
+	if err := s.Init(DefaultCacheSize); err != nil {
+		b.Fatalf("cache init failed, got %v", err)
+	}
+	tok := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tok)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.CompleteBundle(tok)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.SetValidTokens(tok)
+		if s.QueryCache("t1", "s1") == nil {
+			b.Fatal("call to query cache missed when should have hit")
+		}
+		s.CompleteBundle(tok)
+	}
+}
@@ -0,0 +1,128 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import "time"
+
+// subscriberBuffer is the number of events buffered for each subscriber before further
+// events are dropped.
+const subscriberBuffer = 256
+
+// CacheEventType identifies the kind of a CacheEvent.
+type CacheEventType int
+
+const (
+	// EventSet is published when an input, or an empty entry, is cached.
+	EventSet CacheEventType = iota
+	// EventHit is published when a query finds a cached input.
+	EventHit
+	// EventMiss is published when a query finds no cached input.
+	EventMiss
+	// EventEvict is published when an entry is removed from the cache.
+	EventEvict
+	// EventComplete is published when a bundle using a token completes. Its key is unset.
+	EventComplete
+)
+
+func (t CacheEventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventHit:
+		return "hit"
+	case EventMiss:
+		return "miss"
+	case EventEvict:
+		return "evict"
+	case EventComplete:
+		return "complete"
+	default:
+		return "unknown"
+	}
+}
+
+// eventTypes maps the operations of the event log to the events published for them. Entries
+// spilled to the secondary cache or flushed by Clear are published as evicted.
+var eventTypes = map[string]CacheEventType{
+	"set":   EventSet,
+	"hit":   EventHit,
+	"miss":  EventMiss,
+	"evict": EventEvict,
+	"spill": EventEvict,
+	"flush": EventEvict,
+}
+
+// CacheEvent describes a change to the state of a SideInputCache.
+type CacheEvent struct {
+	Type  CacheEventType
+	Key   CacheKey
+	Token []byte
+	Time  time.Time
+}
+
+// Subscribe returns a channel receiving an event for every set, hit, miss, eviction, and bundle
+// completion, for reactive monitoring, along with a function ending the subscription and
+// closing the channel. Events are delivered best effort: once a subscriber lags by more than a
+// bounded number of events, further events are dropped for it and counted by the DroppedEvents
+// metric, so that a slow subscriber never stalls the cache. Any number of subscribers may be
+// active at once. Calling the returned function more than once is safe.
+func (c *SideInputCache) Subscribe() (<-chan CacheEvent, func()) {
+	ch := make(chan CacheEvent, subscriberBuffer)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan CacheEvent]bool)
+	}
+	c.subscribers[ch] = true
+	return ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.subscribers[ch] {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends an event for the event log operation to every subscriber with room for it,
+// counting the event as dropped for the others. It should only be called by a goroutine
+// holding the write lock.
+func (c *SideInputCache) publish(op string, key CacheKey, tok token) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	typ, ok := eventTypes[op]
+	if !ok {
+		return
+	}
+	c.publishEvent(typ, key, tok)
+}
+
+// publishEvent sends an event to every subscriber with room for it. It should only be called
+// by a goroutine holding the write lock.
+func (c *SideInputCache) publishEvent(typ CacheEventType, key CacheKey, tok token) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	ev := CacheEvent{Type: typ, Key: key, Token: []byte(tok), Time: c.now()}
+	for ch := range c.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			c.metrics.DroppedEvents++
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	first, unsubscribeFirst := s.Subscribe()
+	second, unsubscribeSecond := s.Subscribe()
+	defer unsubscribeSecond()
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.QueryCache("t1", "s1")
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.QueryCache("t1", "s1")
+	s.CompleteBundle(tokOne)
+	s.SetValidTokens(makeRequest("t2", "s2", "tok2"))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+
+	keyOne := CacheKey{TransformID: "t1", SideInputID: "s1"}
+	keyTwo := CacheKey{TransformID: "t2", SideInputID: "s2"}
+	want := []CacheEvent{
+		{Type: EventMiss, Key: keyOne, Token: []byte("tok1")},
+		{Type: EventSet, Key: keyOne, Token: []byte("tok1")},
+		{Type: EventHit, Key: keyOne, Token: []byte("tok1")},
+		{Type: EventComplete, Token: []byte("tok1")},
+		{Type: EventEvict, Key: keyOne, Token: []byte("tok1")},
+		{Type: EventSet, Key: keyTwo, Token: []byte("tok2")},
+	}
+	for name, ch := range map[string]<-chan CacheEvent{"first": first, "second": second} {
+		var got []CacheEvent
+		for len(got) < len(want) {
+			ev := <-ch
+			if ev.Time.IsZero() {
+				t.Errorf("%v subscriber event %v has no time", name, ev.Type)
+			}
+			ev.Time = time.Time{}
+			got = append(got, ev)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v subscriber events incorrect, expected %v, got %v", name, want, got)
+		}
+	}
+
+	unsubscribeFirst()
+	if _, ok := <-first; ok {
+		t.Errorf("channel not closed after unsubscribing")
+	}
+	// Unsubscribing again is safe, and the remaining subscriber still receives events.
+	unsubscribeFirst()
+	s.QueryCache("t2", "s2")
+	if ev := <-second; ev.Type != EventHit {
+		t.Errorf("event after unsubscribing another subscriber incorrect, expected %v, got %v", EventHit, ev.Type)
+	}
+}
+
+func TestSubscribe_FlushAndSpill(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1, WithSecondary(&fakeSecondary{}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	ch, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	s.SetValidTokens(tokOne)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.CompleteBundle(tokOne)
+	// Spills the first entry to the secondary cache.
+	s.SetValidTokens(makeRequest("t2", "s2", "tok2"))
+	s.SetCache("t2", "s2", makeTestReusableInput("t2", "s2", 20))
+	s.Clear()
+
+	keyOne := CacheKey{TransformID: "t1", SideInputID: "s1"}
+	keyTwo := CacheKey{TransformID: "t2", SideInputID: "s2"}
+	want := []CacheEvent{
+		{Type: EventSet, Key: keyOne, Token: []byte("tok1")},
+		{Type: EventComplete, Token: []byte("tok1")},
+		{Type: EventEvict, Key: keyOne, Token: []byte("tok1")},
+		{Type: EventSet, Key: keyTwo, Token: []byte("tok2")},
+		{Type: EventEvict, Key: keyTwo, Token: []byte("tok2")},
+	}
+	var got []CacheEvent
+	for len(ch) > 0 {
+		ev := <-ch
+		ev.Time = time.Time{}
+		got = append(got, ev)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events for spilled and flushed entries incorrect, expected %v, got %v", want, got)
+	}
+}
+
+func TestSubscribe_SlowConsumer(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	ch, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	const queries = subscriberBuffer + 10
+	for i := 0; i < queries; i++ {
+		s.QueryCache("t1", "s1")
+	}
+	if m := s.Metrics(); m.DroppedEvents != 10 {
+		t.Errorf("number of dropped events incorrect, expected 10, got %v", m.DroppedEvents)
+	}
+	if len(ch) != subscriberBuffer {
+		t.Errorf("number of buffered events incorrect, expected %v, got %v", subscriberBuffer, len(ch))
+	}
+}
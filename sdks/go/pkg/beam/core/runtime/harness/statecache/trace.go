@@ -0,0 +1,61 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+// Tracer starts spans tracing calls to GetOrPopulate, adapting a tracing library such as
+// OpenCensus or OpenTelemetry to the cache.
+type Tracer interface {
+	// StartSpan starts a span with the given name. It is called while the cache's lock
+	// is held, and must not use the cache.
+	StartSpan(name string) Span
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute tags the span with a key and value.
+	SetAttribute(key, value string)
+	// End ends the span.
+	End()
+}
+
+// startSpan starts a span for a call to GetOrPopulate for the key tagged with its IDs, or
+// returns nil if no tracer is set. It should only be called by a goroutine holding the write
+// lock.
+func (c *SideInputCache) startSpan(key CacheKey) Span {
+	if c.tracer == nil {
+		return nil
+	}
+	span := c.tracer.StartSpan("statecache.GetOrPopulate")
+	if key.Namespace != "" {
+		span.SetAttribute("namespace", key.Namespace)
+	}
+	span.SetAttribute("transform_id", key.TransformID)
+	span.SetAttribute("side_input_id", key.SideInputID)
+	return span
+}
+
+// endSpan tags the span, if any, with the outcome of the call and the error returned to the
+// caller, if any, and ends it.
+func endSpan(span Span, outcome string, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute("outcome", outcome)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	span.End()
+}
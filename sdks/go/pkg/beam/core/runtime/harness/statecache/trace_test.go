@@ -0,0 +1,98 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/internal/errors"
+)
+
+// recordingTracer is a Tracer recording the attributes of every ended span.
+type recordingTracer struct {
+	mu    sync.Mutex
+	ended []map[string]string
+}
+
+func (r *recordingTracer) StartSpan(name string) Span {
+	return &recordingSpan{tracer: r, attrs: map[string]string{"name": name}}
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	attrs  map[string]string
+}
+
+func (s *recordingSpan) SetAttribute(key, value string) {
+	s.attrs[key] = value
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s.attrs)
+}
+
+func TestWithTracer(t *testing.T) {
+	var s SideInputCache
+	tracer := &recordingTracer{}
+	err := s.Init(2, WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"), makeRequest("t2", "s2", "tok2"))
+
+	populate := func() (ReusableInput, error) {
+		return makeTestReusableInput("t1", "s1", 10), nil
+	}
+	if _, err := s.GetOrPopulate("t1", "s1", populate); err != nil {
+		t.Fatalf("GetOrPopulate failed, got %v", err)
+	}
+	if _, err := s.GetOrPopulate("t1", "s1", populate); err != nil {
+		t.Fatalf("GetOrPopulate failed, got %v", err)
+	}
+	s.GetOrPopulate("t2", "s2", func() (ReusableInput, error) {
+		return nil, errors.New("fetch failed")
+	})
+
+	want := []map[string]string{
+		{"name": "statecache.GetOrPopulate", "transform_id": "t1", "side_input_id": "s1", "outcome": "miss"},
+		{"name": "statecache.GetOrPopulate", "transform_id": "t1", "side_input_id": "s1", "outcome": "hit"},
+		{"name": "statecache.GetOrPopulate", "transform_id": "t2", "side_input_id": "s2", "outcome": "miss", "error": "fetch failed"},
+	}
+	if !reflect.DeepEqual(tracer.ended, want) {
+		t.Errorf("spans incorrect, expected %v, got %v", want, tracer.ended)
+	}
+}
+
+func TestWithTracer_Unset(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(1)
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	s.SetValidTokens(makeRequest("t1", "s1", "tok1"))
+	if _, err := s.GetOrPopulate("t1", "s1", func() (ReusableInput, error) {
+		return makeTestReusableInput("t1", "s1", 10), nil
+	}); err != nil {
+		t.Fatalf("GetOrPopulate failed, got %v", err)
+	}
+	if span := s.startSpan(CacheKey{TransformID: "t1", SideInputID: "s1"}); span != nil {
+		t.Errorf("span started without a tracer, got %v", span)
+	}
+}
@@ -0,0 +1,107 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+// lockForEviction takes the write lock after consulting the veto set by WithEvictionVeto, if
+// any, for every entry that may be evicted, so that the veto is called without holding the
+// lock. Entries vetoed, or cached or replaced in between, are not evicted until the lock is
+// released by unlock.
+func (c *SideInputCache) lockForEviction() {
+	allowed := c.consultVeto()
+	c.mu.Lock()
+	c.allowed = allowed
+}
+
+// withEvictionLock runs op holding the write lock, consulting the veto set by WithEvictionVeto
+// only if op needs to evict an entry, so that no veto is called for inputs that fit. If so, op
+// stops before changing anything, and is run again once the veto was consulted as
+// lockForEviction does. The lock is released by unlock once op returns.
+func (c *SideInputCache) withEvictionLock(op func()) {
+	if c.runDeferringVeto(op) {
+		return
+	}
+	c.lockForEviction()
+	defer c.unlock()
+	op()
+}
+
+// runDeferringVeto runs op holding the write lock without consulting the veto, returning false
+// if op stopped since it needed to evict.
+func (c *SideInputCache) runDeferringVeto(op func()) bool {
+	c.mu.Lock()
+	defer c.unlock()
+	c.deferVeto = c.veto != nil
+	op()
+	return !c.vetoDue
+}
+
+// awaitVeto reports whether an eviction must wait for the veto to be consulted since the lock
+// was taken by runDeferringVeto, recording that it is due. It should only be called by a
+// goroutine holding the write lock before evicting anything.
+func (c *SideInputCache) awaitVeto() bool {
+	if !c.deferVeto {
+		return false
+	}
+	c.vetoDue = true
+	return true
+}
+
+// consultVeto returns the entries that may be evicted and were not vetoed, or nil if no veto is
+// set. The veto is called without holding the lock.
+func (c *SideInputCache) consultVeto() map[CacheKey]*cacheEntry {
+	c.mu.RLock()
+	veto := c.veto
+	if veto == nil {
+		c.mu.RUnlock()
+		return nil
+	}
+	var candidates []*cacheEntry
+	for key, entry := range c.cache {
+		if c.releasable(key) {
+			candidates = append(candidates, entry)
+		}
+	}
+	c.mu.RUnlock()
+
+	allowed := make(map[CacheKey]*cacheEntry, len(candidates))
+	for _, entry := range candidates {
+		if !veto(entry.key, entry.input) {
+			allowed[entry.key] = entry
+		}
+	}
+	return allowed
+}
+
+// vetoed reports whether the entry for the key may not be evicted since the veto set by
+// WithEvictionVeto was not consulted for it, or vetoed its eviction. It should only be called
+// by a goroutine holding the lock.
+func (c *SideInputCache) vetoed(key CacheKey) bool {
+	return c.veto != nil && c.allowed[key] != c.cache[key]
+}
+
+// anyVetoed reports whether an entry that is otherwise evictable may not be evicted because
+// of the veto. It should only be called by a goroutine holding the lock.
+func (c *SideInputCache) anyVetoed() bool {
+	if c.veto == nil {
+		return false
+	}
+	for key := range c.cache {
+		if c.releasable(key) && c.vetoed(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statecache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestWithEvictionVeto(t *testing.T) {
+	var s SideInputCache
+	var consulted []CacheKey
+	veto := map[string]bool{"s1": true}
+	err := s.Init(2, WithEvictionVeto(func(key CacheKey, in ReusableInput) bool {
+		consulted = append(consulted, key)
+		// The veto must be able to re-enter the cache without deadlocking.
+		s.Metrics()
+		return veto[key.SideInputID]
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+
+	tokOne := makeRequest("t1", "s1", "tok1")
+	tokTwo := makeRequest("t1", "s2", "tok2")
+	s.SetValidTokens(tokOne, tokTwo)
+	s.SetCache("t1", "s1", makeTestReusableInput("t1", "s1", 10))
+	s.SetCache("t1", "s2", makeTestReusableInput("t1", "s2", 20))
+	if len(consulted) != 0 {
+		t.Errorf("veto consulted for entries in use, got %v", consulted)
+	}
+	s.CompleteBundle(tokOne, tokTwo)
+
+	// s1 is the least recently used, but is vetoed, so s2 is evicted instead.
+	s.SetValidTokens(makeRequest("t1", "s3", "tok3"))
+	s.SetCache("t1", "s3", makeTestReusableInput("t1", "s3", 30))
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; !ok {
+		t.Errorf("vetoed entry evicted")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s2"}]; ok {
+		t.Errorf("entry not vetoed kept")
+	}
+	if len(consulted) != 2 {
+		t.Errorf("veto not consulted for every candidate, got %v", consulted)
+	}
+
+	// The only evictable entry is vetoed, so the input is not cached.
+	s.SetValidTokens(makeRequest("t1", "s4", "tok4"))
+	if s.TrySetCache("t1", "s4", makeTestReusableInput("t1", "s4", 40)) {
+		t.Errorf("input cached though every candidate was vetoed")
+	}
+	if m := s.Metrics(); m.VetoedEvictions != 1 || m.InUseEvictions != 0 {
+		t.Errorf("failed evictions incorrect, expected 1 vetoed and 0 in use, got %v and %v", m.VetoedEvictions, m.InUseEvictions)
+	}
+
+	// Once the veto lifts, the entry is evicted as usual.
+	veto["s1"] = false
+	if !s.TrySetCache("t1", "s4", makeTestReusableInput("t1", "s4", 40)) {
+		t.Errorf("input not cached once the veto lifted")
+	}
+	if _, ok := s.cache[CacheKey{TransformID: "t1", SideInputID: "s1"}]; ok {
+		t.Errorf("entry no longer vetoed kept")
+	}
+}
+
+func TestWithEvictionVeto_NotConsultedWhenInputFits(t *testing.T) {
+	var s SideInputCache
+	consulted := 0
+	err := s.Init(100, WithEvictionVeto(func(CacheKey, ReusableInput) bool {
+		consulted++
+		return false
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		side := fmt.Sprintf("s%d", i)
+		tok := makeRequest("t1", side, token(side))
+		s.SetValidTokens(tok)
+		s.SetCache("t1", side, makeTestReusableInput("t1", side, i))
+		s.CompleteBundle(tok)
+	}
+	if err := s.Resize(60); err != nil {
+		t.Fatalf("Resize(60) failed, got %v", err)
+	}
+	if consulted != 0 {
+		t.Errorf("veto calls incorrect, expected 0, got %v", consulted)
+	}
+
+	// Shrinking below the number of entries needs victims, so the veto is consulted.
+	if err := s.Resize(40); err != nil {
+		t.Fatalf("Resize(40) failed, got %v", err)
+	}
+	if consulted != 50 {
+		t.Errorf("veto calls incorrect, expected 50, got %v", consulted)
+	}
+	if got, want := len(s.cache), 40; got != want {
+		t.Errorf("number of entries incorrect, expected %v, got %v", want, got)
+	}
+}
+
+func TestWithEvictionVeto_EvictionOrder(t *testing.T) {
+	var s SideInputCache
+	err := s.Init(3, WithEvictionVeto(func(key CacheKey, _ ReusableInput) bool {
+		return key.SideInputID == "s2"
+	}))
+	if err != nil {
+		t.Fatalf("cache init failed, got %v", err)
+	}
+	for _, side := range []string{"s1", "s2", "s3"} {
+		tok := makeRequest("t1", side, token(side))
+		s.SetValidTokens(tok)
+		s.SetCache("t1", side, makeTestReusableInput("t1", side, 1))
+		s.CompleteBundle(tok)
+	}
+	want := []CacheKey{{TransformID: "t1", SideInputID: "s1"}, {TransformID: "t1", SideInputID: "s3"}}
+	got := s.EvictionOrder()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("eviction order incorrect, expected %v, got %v", want, got)
+	}
+	if n := s.EvictFraction(1); n != 2 {
+		t.Errorf("number of entries evicted incorrect, expected 2, got %v", n)
+	}
+}